@@ -0,0 +1,132 @@
+package databaseInterface
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Ошибка составной операции над несколькими коллекциями
+//Atomic - операция выполнялась в транзакции
+//RolledBack - частичные изменения отменены транзакцией или компенсацией
+type OperationError struct {
+	Atomic     bool
+	RolledBack bool
+	Err        error
+}
+
+func (e *OperationError) Error() string {
+	res := e.Err.Error()
+	if e.Atomic {
+		return res + " (transaction aborted)"
+	}
+	if e.RolledBack {
+		return res + " (not atomic, changes rolled back)"
+	}
+	return res + " (not atomic, rollback failed)"
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+//Журнал компенсирующих действий для серверов без транзакций
+type undoLog struct {
+	steps []func(ctx context.Context) error
+}
+
+//Запоминаем действие, отменяющее только что выполненный шаг
+func (u *undoLog) push(step func(ctx context.Context) error) {
+	u.steps = append(u.steps, step)
+}
+
+//Отменяем шаги в обратном порядке, выполняя все даже при ошибках
+func (u *undoLog) rollback(ctx context.Context) error {
+	var res error
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		err := u.steps[i](ctx)
+		if err != nil {
+			log.Println(err)
+			res = err
+		}
+	}
+	u.steps = nil
+	return res
+}
+
+//Проверяем, поддерживает ли сервер транзакции (реплика-сет или шардированный кластер)
+func (d DatabaseInterface) transactionsSupported() bool {
+	var res bson.M
+	err := d.database.RunCommand(context.TODO(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	_, replicaSet := res["setName"]
+	return replicaSet || res["msg"] == "isdbgrid"
+}
+
+//Выполняем операцию над несколькими коллекциями
+//Если есть поддержка транзакций, операция выполняется в транзакции,
+//иначе при ошибке выполняются компенсирующие действия из журнала undo
+//Все запросы операции должны использовать переданный контекст
+func (d DatabaseInterface) runAtomic(operation func(ctx context.Context, undo *undoLog) error) error {
+	if d.transactions {
+		session, err := d.client.StartSession()
+		if err != nil {
+			return &OperationError{Atomic: true, RolledBack: true, Err: err}
+		}
+		defer session.EndSession(context.TODO())
+
+		_, err = session.WithTransaction(context.TODO(), func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, operation(sc, &undoLog{})
+		})
+		if err != nil {
+			return &OperationError{Atomic: true, RolledBack: true, Err: err}
+		}
+		return nil
+	}
+
+	undo := &undoLog{}
+	err := operation(context.TODO(), undo)
+	if err != nil {
+		rollbackErr := undo.rollback(context.TODO())
+		return &OperationError{Atomic: false, RolledBack: rollbackErr == nil, Err: err}
+	}
+	return nil
+}
+
+//Устанавливаем поля документа и запоминаем их прошлые значения для отмены
+//Возвращает документ до изменения
+func setWithUndo(ctx context.Context, undo *undoLog, collection *mongo.Collection, id primitive.ObjectID, fields bson.D) (bson.M, error) {
+	projection := bson.D{}
+	for i := 0; i < len(fields); i++ {
+		projection = append(projection, bson.E{Key: fields[i].Key, Value: 1})
+	}
+
+	var old bson.M
+	err := collection.FindOneAndUpdate(
+		ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: fields}},
+		options.FindOneAndUpdate().SetProjection(projection),
+	).Decode(&old)
+	if err != nil {
+		return nil, err
+	}
+
+	revert := bson.D{}
+	for i := 0; i < len(fields); i++ {
+		revert = append(revert, bson.E{Key: fields[i].Key, Value: old[fields[i].Key]})
+	}
+	undo.push(func(ctx context.Context) error {
+		_, err := collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: revert}})
+		return err
+	})
+	return old, nil
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/rsa"
 	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,8 +19,13 @@ import (
 )
 
 const LIMIT = 20
+const LIMIT_MAX = 100
 const SECURED_MESSAGE_LIMIT = 245
-const DATE_FORMAT = "2006-01-02 15:04:05"
+
+//Через это время выданный номер сообщения считается брошенным, см. getChatSeq
+const PENDING_SEQ_TTL = time.Minute
+
+var ErrMessageTooLong = errors.New("MESSAGE_TOO_LONG")
 
 type DatabaseInterface struct {
 	clientOptions          options.ClientOptions
@@ -31,6 +38,7 @@ type DatabaseInterface struct {
 	collectionChatsArray   mongo.Collection
 	collectionChatSettings mongo.Collection
 	collectionUserSettings mongo.Collection
+	transactions           bool //Сервер поддерживает транзакции
 }
 
 //Функция инициальзации подключения к бд и создания интерфейса взаимодействия
@@ -69,7 +77,7 @@ func New(
 	log.Print("Connected to database\n")
 	log.Print(coll_chats)
 
-	return DatabaseInterface{
+	d := DatabaseInterface{
 		*clientOptions,
 		*client,
 		*db,
@@ -80,6 +88,88 @@ func New(
 		*collectionChatsArray,
 		*collectionChatSettings,
 		*collectionUserSettings,
+		false,
+	}
+	d.transactions = d.transactionsSupported()
+	if !d.transactions {
+		log.Print("Transactions are not supported, using compensating rollback\n")
+	}
+	d.ensureIndexes()
+
+	return d
+}
+
+//Создаем индексы коллекций
+func (d DatabaseInterface) ensureIndexes() {
+	//Номер сообщения уникален в пределах чата
+	_, err := d.collectionMessages.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+			{Key: "seq", Value: bson.D{{Key: "$exists", Value: true}}},
+		}),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	//Повторная отправка с тем же id клиента не создает новое сообщение
+	_, err = d.collectionMessages.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+			{Key: "client_id", Value: bson.D{{Key: "$type", Value: "string"}}},
+		}),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	//Один персональный чат на пару собеседников
+	_, err = d.collectionChats.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "pair_key", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+			{Key: "pair_key", Value: bson.D{{Key: "$type", Value: "string"}}},
+		}),
+	})
+	if err != nil {
+		log.Println("Personal chats have duplicates, run merge-personal-chats")
+		log.Println(err)
+	}
+
+	//Поиск чатов в каталоге по названию и описанию
+	_, err = d.collectionChats.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "chat_name", Value: "text"},
+			{Key: "description", Value: "text"},
+		},
+		Options: options.Index().SetDefaultLanguage("none"),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	//Полнотекстовый поиск по незащищенным сообщениям
+	_, err = d.collectionMessages.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "search_text", Value: "text"}},
+		Options: options.Index().SetDefaultLanguage("none"),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	//Сообщения с датой истечения удаляются автоматически
+	_, err = d.collectionMessages.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiredat", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	//Файлы по дате истечения не удаляются: логотипы чатов хранятся, пока на них ссылается чат
+	//Убираем индекс, если он был создан раньше
+	_, err = d.collectionFiles.Indexes().DropOne(context.TODO(), "expiredat_1")
+	if err != nil && !strings.Contains(err.Error(), "index not found") {
+		log.Println(err)
 	}
 }
 
@@ -220,32 +310,18 @@ func (d DatabaseInterface) GetUsersChatsId(user_id string) ([]structures.Chat_Id
 	return res, err
 }
 
-//Получаем данные пользователя
-//Агрегируем настройки и список чатов
-func (d DatabaseInterface) GetUser(login string, limit int, offset int) ([]structures.User, error) {
-	var res []structures.User
-	filter := bson.D{primitive.E{Key: "login", Value: login}}
-	err := d.collectionUsers.FindOne(context.TODO(), filter).Decode(&res)
-	return res, err
-}
-
-//Получаем данные пользователя по id
-func (d DatabaseInterface) GetUserId(user_id string, requested_user_id string) (structures.User_lite, error) {
-	var res structures.User_lite
-	reqUserId, _ := primitive.ObjectIDFromHex(requested_user_id)
-	//userId, err := primitive.ObjectIDFromHex(user_id)
-
-	cur, err := (d.collectionUsers.Aggregate(context.TODO(), mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "_id", Value: reqUserId}}}},
-		bson.D{{Key: "$project", Value: bson.D{
+//Стадии агрегации, приводящие пользователя к User_lite
+//Контакты не вырезаются, их скрывает hidePrivateFields по настройкам приватности
+func userLiteStages() []bson.D {
+	return []bson.D{
+		{{Key: "$project", Value: bson.D{
 			{Key: "password", Value: 0},
 			{Key: "chats_array", Value: 0},
-			{Key: "email", Value: 0},
-			{Key: "phone", Value: 0},
+			{Key: "blocked_array", Value: 0},
 			{Key: "personal_settings", Value: 0},
 		},
 		}},
-		bson.D{{Key: "$lookup", Value: bson.D{
+		{{Key: "$lookup", Value: bson.D{
 			{Key: "from", Value: "Files"},
 			{Key: "localField", Value: "photos_array"},
 			{Key: "foreignField", Value: "_id"},
@@ -259,14 +335,57 @@ func (d DatabaseInterface) GetUserId(user_id string, requested_user_id string) (
 			}},
 		},
 		}},
-		bson.D{{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "Personal_setting"},
-			{Key: "localField", Value: "personal_setting"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "personal_setting"},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Personal_settings"},
+			{Key: "let", Value: bson.D{{Key: "user_id", Value: bson.D{{Key: "$toString", Value: "$_id"}}}}},
+			{Key: "as", Value: "personal_settings"},
+			{Key: "pipeline", Value: []bson.D{
+				{{
+					Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{
+						{Key: "$eq", Value: bson.A{"$user_id", "$$user_id"}},
+					}}},
+				}},
+			}},
 		},
 		}},
-	}))
+		{{Key: "$unwind", Value: bson.D{
+			{Key: "path", Value: "$personal_settings"},
+			{Key: "preserveNullAndEmptyArrays", Value: true},
+		}}},
+	}
+}
+
+//Скрываем почту и телефон, если пользователь запретил их показывать
+func (d DatabaseInterface) hidePrivateFields(user_id string, user *structures.User_lite) {
+	if user_id == user.Id.Hex() {
+		return
+	}
+	if !user.Personal_settings.Email_visible {
+		user.Email = nil
+	}
+	if !user.Personal_settings.Phone_visible {
+		user.Phone = nil
+	}
+	if !d.lastSeenAllowed(user.Personal_settings.Last_seen_visibility, user.Id.Hex(), user_id) {
+		user.Last_seen = structures.Date(time.Time{})
+	}
+}
+
+//Получаем данные пользователя по id
+func (d DatabaseInterface) GetUserId(user_id string, requested_user_id string) (structures.User_lite, error) {
+	var res structures.User_lite
+	reqUserId, _ := primitive.ObjectIDFromHex(requested_user_id)
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "_id", Value: reqUserId}}}},
+	}
+	pipeline = append(pipeline, userLiteStages()...)
+
+	cur, err := d.collectionUsers.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		log.Println(err)
+		return res, err
+	}
 
 	for cur.Next(context.TODO()) {
 		var elem structures.User_lite
@@ -277,14 +396,7 @@ func (d DatabaseInterface) GetUserId(user_id string, requested_user_id string) (
 		res = elem
 	}
 
-	if user_id != requested_user_id {
-		if !res.Personal_settings.Email_visible {
-			res.Email = nil
-		}
-		if !res.Personal_settings.Phone_visible {
-			res.Phone = nil
-		}
-	}
+	d.hidePrivateFields(user_id, &res)
 
 	return res, err
 }
@@ -313,6 +425,12 @@ func (d DatabaseInterface) GetUsersOfChat(user_id string, chat_id string, limit
 		return nil, err
 	}
 
+	//Подписчиков канала видят только те, кто может их банить
+	settings, _ := d.getChatsOptions(chat_id)
+	if settings != nil && settings.Channel && !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_BAN) {
+		return nil, errors.New("channel members are hidden")
+	}
+
 	if limit <= 0 {
 		limit = LIMIT
 	}
@@ -393,7 +511,7 @@ func (d DatabaseInterface) GetMessage(user_id string, message_id string, chat_id
 	cur, err := (d.collectionMessages.Aggregate(context.TODO(), mongo.Pipeline{
 		bson.D{{Key: "$match", Value: bson.D{{Key: "_id", Value: objectId}}}},
 		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "expiredAt", Value: 0},
+			{Key: "expiredat", Value: 0},
 		}}},
 		bson.D{{Key: "$lookup", Value: bson.D{
 			{Key: "from", Value: "Users"},
@@ -486,6 +604,9 @@ func (d DatabaseInterface) GetChat(user_id string, chat_id string) (structures.C
 			{Key: "_id", Value: 1},
 			{Key: "chat_name", Value: 1},
 			{Key: "chat_logo", Value: 1},
+			{Key: "description", Value: 1},
+			{Key: "owner_id", Value: 1},
+			{Key: "admins_array", Value: 1},
 			{Key: "options", Value: 1},
 		}}},
 		bson.D{{
@@ -533,7 +654,7 @@ func (d DatabaseInterface) GetChat(user_id string, chat_id string) (structures.C
 				{Key: "pipeline", Value: []bson.D{
 					{{
 						Key: "$sort", Value: bson.D{
-							{Key: "gtm_date", Value: -1},
+							{Key: "seq", Value: -1},
 						},
 					}},
 					{{
@@ -571,6 +692,10 @@ func (d DatabaseInterface) GetChat(user_id string, chat_id string) (structures.C
 		}
 
 		elem.Last_message_content = m
+		//В каналах вместо участников показываем число подписчиков
+		if len(elem.Options) > 0 && elem.Options[0].Channel {
+			elem.Subscribers_count = elem.Users_count - int64(len(elem.Admins_array))
+		}
 		res = append(res, elem)
 	}
 
@@ -647,6 +772,11 @@ func (d DatabaseInterface) UserInChat(user_id string, chat_id string) bool {
 		}
 	}
 
+	//Забаненный пользователь не считается участником
+	if res && d.UserBanned(user_id, chat_id) {
+		return false
+	}
+
 	return res
 }
 
@@ -671,195 +801,392 @@ func (d DatabaseInterface) updateUserLastMessagesCount(user_id string, chat_id s
 	return res, err
 }
 
-//Получить сообщения
-func (d DatabaseInterface) GetMessages(user_id string, chat_id string, limit int, offset int) ([]structures.MessageToUser, error) {
+//Стадия агрегации, добавляющая к сообщению данные автора
+func messageUserLookup() bson.D {
+	return bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: "Users"},
+		{Key: "localField", Value: "user_id"},
+		{Key: "foreignField", Value: "_id"},
+		{Key: "as", Value: "user"},
+		{Key: "pipeline", Value: []bson.D{
+			{{
+				Key: "$project", Value: bson.D{
+					{Key: "password", Value: 0},
+					{Key: "chats_array", Value: 0},
+					{Key: "email", Value: 0},
+					{Key: "phone", Value: 0},
+					{Key: "personal_settings", Value: 0},
+				},
+			}},
+			{{
+				Key: "$lookup", Value: bson.D{
+					{Key: "from", Value: "Files"},
+					{Key: "localField", Value: "photos_array"},
+					{Key: "foreignField", Value: "_id"},
+					{Key: "as", Value: "photos_array"},
+					{Key: "pipeline", Value: []bson.D{
+						{{
+							Key: "$project", Value: bson.D{
+								{Key: "url", Value: 1},
+							},
+						}},
+					}},
+				},
+			}},
+		}},
+	}}}
+}
+
+//Ищем сообщения чата по фильтру, sort - направление сортировки по номеру
+//Отдаются только сообщения с номером не больше last, см. getChatSeq
+func (d DatabaseInterface) findMessages(chat_id primitive.ObjectID, filter bson.D, last int64, sort int, limit int) ([]structures.MessageToUser, error) {
 	var res []structures.MessageToUser
-	objectId, err := primitive.ObjectIDFromHex(chat_id)
 
+	match := bson.D{
+		{Key: "chat_id", Value: chat_id},
+		{Key: "$and", Value: bson.A{filter, bson.D{{Key: "seq", Value: bson.D{{Key: "$lte", Value: last}}}}}},
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "seq", Value: sort},
+		}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "expiredat", Value: 0},
+		}}},
+		messageUserLookup(),
+	)
+
+	cur, err := d.collectionMessages.Aggregate(context.TODO(), pipeline)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	//Если пользователь не состоит в чате
-	if !d.UserInChat(user_id, chat_id) {
-		var er error
-		log.Println("User not in chat - getting messages")
-		return nil, er
-	}
+	for cur.Next(context.TODO()) {
+		var elem structures.MessageToUser
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
 
-	if limit <= 0 {
-		limit = LIMIT
+		res = append(res, elem)
 	}
 
-	if offset < limit || offset < 0 {
-		offset = 0
+	return res, nil
+}
+
+//Проверяем есть ли в чате сообщения, подходящие под фильтр
+func (d DatabaseInterface) hasMessages(chat_id primitive.ObjectID, filter bson.D) bool {
+	match := append(bson.D{{Key: "chat_id", Value: chat_id}}, filter...)
+	count, err := d.collectionMessages.CountDocuments(context.TODO(), match, options.Count().SetLimit(1))
+	if err != nil {
+		log.Println(err)
+		return false
 	}
+	return count > 0
+}
 
-	cur, err := (d.collectionMessages.Aggregate(context.TODO(), mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "chat_id", Value: objectId}}}},
-		bson.D{{Key: "$sort", Value: bson.D{
-			{Key: "gtm_date", Value: -1},
-		}}},
-		bson.D{{Key: "$skip", Value: offset}},
-		bson.D{{Key: "$limit", Value: limit}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "expiredAt", Value: 0},
-		}}},
-		bson.D{{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "Users"},
-			{Key: "localField", Value: "user_id"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "user"},
-			{Key: "pipeline", Value: []bson.D{
-				{{
-					Key: "$project", Value: bson.D{
-						{Key: "password", Value: 0},
-						{Key: "chats_array", Value: 0},
-						{Key: "email", Value: 0},
-						{Key: "phone", Value: 0},
-						{Key: "personal_settings", Value: 0},
-					},
-				}},
-				{{
-					Key: "$lookup", Value: bson.D{
-						{Key: "from", Value: "Files"},
-						{Key: "localField", Value: "photos_array"},
-						{Key: "foreignField", Value: "_id"},
-						{Key: "as", Value: "photos_array"},
-						{Key: "pipeline", Value: []bson.D{
-							{{
-								Key: "$project", Value: bson.D{
-									{Key: "url", Value: 1},
-								},
-							}},
-						}},
-					},
+//Получаем следующий номер сообщения в чате
+func (d DatabaseInterface) nextMessageSeq(chat_id primitive.ObjectID) (int64, error) {
+	var res structures.Chat_Seq
+	err := d.collectionChats.FindOneAndUpdate(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chat_id}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "messages_seq", Value: 1}}}},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.D{{Key: "messages_seq", Value: 1}}),
+	).Decode(&res)
+
+	return res.Messages_seq, err
+}
+
+//Выдаем номер для нового сообщения и запоминаем его как незаписанный
+//Номер и отметка ставятся одним обновлением, чтобы читатели не увидели номер раньше сообщения
+func (d DatabaseInterface) reserveMessageSeq(chat_id primitive.ObjectID) (int64, error) {
+	var res structures.Chat_Seq
+	err := d.collectionChats.FindOneAndUpdate(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chat_id}},
+		mongo.Pipeline{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "messages_seq", Value: bson.D{
+				{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$messages_seq", 0}}}, 1}},
+			}}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "pending_seq", Value: bson.D{
+				{Key: "$concatArrays", Value: bson.A{
+					bson.D{{Key: "$ifNull", Value: bson.A{"$pending_seq", bson.A{}}}},
+					bson.A{bson.D{{Key: "seq", Value: "$messages_seq"}, {Key: "date", Value: "$$NOW"}}},
 				}},
-			}},
-		}}},
-	}))
+			}}}}},
+		},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.D{{Key: "messages_seq", Value: 1}}),
+	).Decode(&res)
+
+	return res.Messages_seq, err
+}
+
+//Снимаем отметку с номера после записи сообщения, в том числе неудачной
+func (d DatabaseInterface) releaseMessageSeq(chat_id primitive.ObjectID, seq int64) {
+	_, err := d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chat_id}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "pending_seq", Value: bson.D{{Key: "seq", Value: seq}}}}}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Записываем сообщение со следующим номером чата
+func (d DatabaseInterface) insertWithSeq(msg structures.Message_noid) (*mongo.InsertOneResult, int64, error) {
+	seq, err := d.reserveMessageSeq(msg.Chat_id)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, err
+	}
+	msg.Seq = seq
+
+	res, err := d.collectionMessages.InsertOne(context.TODO(), msg)
+	d.releaseMessageSeq(msg.Chat_id, seq)
+	return res, seq, err
+}
+
+//Получаем номер, до которого записаны все сообщения чата
+//Сообщения с большими номерами могут еще записываться, читатели их не получают,
+//иначе курсор перескочит через сообщение, которое запишется позже
+//Отметки старше PENDING_SEQ_TTL остались от упавших запросов и не учитываются
+func (d DatabaseInterface) getChatSeq(chat_id primitive.ObjectID) int64 {
+	var res structures.Chat_Seq
+	err := d.collectionChats.FindOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chat_id}},
+		options.FindOne().SetProjection(bson.D{{Key: "messages_seq", Value: 1}, {Key: "pending_seq", Value: 1}}),
+	).Decode(&res)
+	if err != nil {
+		log.Println(err)
+	}
 
-	v, _ := d.GetChatMessagesCount(chat_id)
+	last := res.Messages_seq
+	stale := time.Now().Add(-PENDING_SEQ_TTL)
+	for i := 0; i < len(res.Pending_seq); i++ {
+		if res.Pending_seq[i].Date.Time().After(stale) && res.Pending_seq[i].Seq <= last {
+			last = res.Pending_seq[i].Seq - 1
+		}
+	}
+	return last
+}
+
+//Отмечаем чат прочитанным пользователем
+func (d DatabaseInterface) markChatRead(user_id string, chat_id primitive.ObjectID) error {
+	v, _ := d.GetChatMessagesCount(chat_id.Hex())
 	update := bson.D{
 		primitive.E{Key: "$set", Value: bson.D{
 			primitive.E{Key: "last_messages_number", Value: v},
 		}},
+		primitive.E{Key: "$max", Value: bson.D{
+			primitive.E{Key: "last_read_seq", Value: d.getChatSeq(chat_id)},
+		}},
 	}
 	userId, _ := primitive.ObjectIDFromHex(user_id)
-	_, err = d.collectionChatsArray.UpdateOne(context.TODO(), bson.D{{Key: "user_id", Value: userId}, {Key: "chat_id", Value: objectId}}, update)
+	_, err := d.collectionChatsArray.UpdateOne(context.TODO(), bson.D{{Key: "user_id", Value: userId}, {Key: "chat_id", Value: chat_id}}, update)
 
-	for cur.Next(context.TODO()) {
-		var elem structures.MessageToUser
-		err := cur.Decode(&elem)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
+	return err
+}
 
-		res = append(res, elem)
+//Отмечаем прочитанными сообщения до seq включительно, seq <= 0 - весь чат
+//Номер прочтения только растет, возвращается итоговый номер
+func (d DatabaseInterface) MarkChatRead(user_id string, chat_id string, seq int64) (int64, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return 0, errors.New("invalid chat_id")
+	}
+	if !d.UserInChat(user_id, chat_id) {
+		return 0, errors.New("user not in chat")
 	}
 
-	return res, err
+	last := d.getChatSeq(chatId)
+	if seq <= 0 || seq > last {
+		seq = last
+	}
+
+	var res structures.Chats_array
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+	err = d.collectionChatsArray.FindOneAndUpdate(
+		context.TODO(),
+		bson.D{{Key: "user_id", Value: userId}, {Key: "chat_id", Value: chatId}},
+		bson.D{{Key: "$max", Value: bson.D{{Key: "last_read_seq", Value: seq}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&res)
+
+	return res.Last_read_seq, err
 }
 
-//Получить новые сообщения
-func (d DatabaseInterface) GetNewMessages(user_id string, chat_id string) ([]structures.MessageToUser, error) {
-	var res []structures.MessageToUser
+//Сохраняем черновик сообщения в чате, пустой текст удаляет черновик
+//В защищенных чатах клиент сам шифрует черновик ключом чата
+func (d DatabaseInterface) SaveDraft(user_id string, chat_id string, text string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	if !d.UserInChat(user_id, chat_id) {
+		return errors.New("user not in chat")
+	}
+
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+	_, err = d.collectionChatsArray.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "user_id", Value: userId}, {Key: "chat_id", Value: chatId}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "draft", Value: text}}}},
+	)
+	return err
+}
+
+//Получить сообщения по курсору
+//before - сообщения с номером меньше курсора, after - с номером больше курсора,
+//around - сообщения вокруг курсора. Курсор < 0 не передан, after может быть 0.
+//Без курсора возвращаются последние сообщения.
+//Сообщения на странице отсортированы от новых к старым
+func (d DatabaseInterface) GetMessages(user_id string, chat_id string, limit int, before int64, after int64, around int64) (structures.MessagesPage, error) {
+	var page structures.MessagesPage
 	objectId, err := primitive.ObjectIDFromHex(chat_id)
 
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return page, err
 	}
 
 	//Если пользователь не состоит в чате
 	if !d.UserInChat(user_id, chat_id) {
-		var er error
 		log.Println("User not in chat - getting messages")
-		return nil, er
+		return page, errors.New("user not in chat")
 	}
 
-	settings, _ := d.GetUsersChat(user_id, chat_id)
-	limit := settings.Last_messages_number
-	cur, _ := (d.collectionMessages.Aggregate(context.TODO(), mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "chat_id", Value: objectId}}}},
-		bson.D{{Key: "$sort", Value: bson.D{
-			{Key: "gtm_date", Value: 1},
-		}}},
-		bson.D{{Key: "$skip", Value: limit}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "expiredAt", Value: 0},
-		}}},
-		bson.D{{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "Users"},
-			{Key: "localField", Value: "user_id"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "user"},
-			{Key: "pipeline", Value: []bson.D{
-				{{
-					Key: "$project", Value: bson.D{
-						{Key: "password", Value: 0},
-						{Key: "chats_array", Value: 0},
-						{Key: "email", Value: 0},
-						{Key: "phone", Value: 0},
-						{Key: "personal_settings", Value: 0},
-					},
-				}},
-				{{
-					Key: "$lookup", Value: bson.D{
-						{Key: "from", Value: "Files"},
-						{Key: "localField", Value: "photos_array"},
-						{Key: "foreignField", Value: "_id"},
-						{Key: "as", Value: "photos_array"},
-						{Key: "pipeline", Value: []bson.D{
-							{{
-								Key: "$project", Value: bson.D{
-									{Key: "url", Value: 1},
-								},
-							}},
-						}},
-					},
-				}},
-			}},
-		}}},
-	}))
-
-	v, _ := d.GetChatMessagesCount(chat_id)
-	update := bson.D{
-		primitive.E{Key: "$set", Value: bson.D{
-			primitive.E{Key: "last_messages_number", Value: v},
-		}},
+	if limit <= 0 || limit > LIMIT_MAX {
+		limit = LIMIT
 	}
-	userId, _ := primitive.ObjectIDFromHex(user_id)
-	_, err = d.collectionChatsArray.UpdateOne(context.TODO(), bson.D{{Key: "user_id", Value: userId}, {Key: "chat_id", Value: objectId}}, update)
 
-	for cur.Next(context.TODO()) {
-		var elem structures.MessageToUser
-		err := cur.Decode(&elem)
+	var older, newer []structures.MessageToUser
+	hasOlder, hasNewer := false, false
+	last := d.getChatSeq(objectId)
+
+	switch {
+	case after >= 0:
+		newer, err = d.findMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$gt", Value: after}}}}, last, 1, limit+1)
+		if len(newer) > limit {
+			newer = newer[:limit]
+			hasNewer = true
+		}
+		hasOlder = d.hasMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$lte", Value: after}}}})
+	case around > 0:
+		half := limit / 2
+		older, err = d.findMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$lt", Value: around}}}}, last, -1, half+1)
 		if err != nil {
-			log.Fatal(err)
-			return nil, err
+			return page, err
 		}
+		if len(older) > half {
+			older = older[:half]
+			hasOlder = true
+		}
+		newer, err = d.findMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$gte", Value: around}}}}, last, 1, limit-half+1)
+		if len(newer) > limit-half {
+			newer = newer[:limit-half]
+			hasNewer = true
+		}
+	case before > 0:
+		older, err = d.findMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$lt", Value: before}}}}, last, -1, limit+1)
+		if len(older) > limit {
+			older = older[:limit]
+			hasOlder = true
+		}
+		hasNewer = d.hasMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$gte", Value: before}}}})
+	default:
+		older, err = d.findMessages(objectId, bson.D{}, last, -1, limit+1)
+		if len(older) > limit {
+			older = older[:limit]
+			hasOlder = true
+		}
+	}
+	if err != nil {
+		return page, err
+	}
 
-		res = append(res, elem)
+	//Новые сообщения получены по возрастанию, разворачиваем
+	for i := len(newer) - 1; i >= 0; i-- {
+		page.Messages = append(page.Messages, newer[i])
+	}
+	page.Messages = append(page.Messages, older...)
+
+	if len(page.Messages) > 0 {
+		if hasOlder {
+			page.Next_cursor = strconv.FormatInt(page.Messages[len(page.Messages)-1].Seq, 10)
+		}
+		if hasNewer {
+			page.Prev_cursor = strconv.FormatInt(page.Messages[0].Seq, 10)
+		}
+	}
+
+	err = d.markChatRead(user_id, objectId)
+
+	return page, err
+}
+
+//Получить новые сообщения, то есть сообщения после курсора after
+//Если курсор не передан (after < 0), берем последний прочитанный номер
+func (d DatabaseInterface) GetNewMessages(user_id string, chat_id string, after int64) ([]structures.MessageToUser, error) {
+	objectId, err := primitive.ObjectIDFromHex(chat_id)
+
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	//Если пользователь не состоит в чате
+	if !d.UserInChat(user_id, chat_id) {
+		log.Println("User not in chat - getting messages")
+		return nil, errors.New("user not in chat")
+	}
+
+	if after < 0 {
+		settings, _ := d.GetUsersChat(user_id, chat_id)
+		after = settings.Last_read_seq
 	}
+	last := d.getChatSeq(objectId)
+
+	res, err := d.findMessages(objectId, bson.D{{Key: "seq", Value: bson.D{{Key: "$gt", Value: after}}}}, last, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.markChatRead(user_id, objectId)
 
 	return res, err
 }
 
 //Метод получения расшифрованных сообщений
-func (d DatabaseInterface) GetDecryptedMessages(user_id string, chat_id string, limit int, offset int) ([]structures.MessageToUser, error) {
+func (d DatabaseInterface) GetDecryptedMessages(user_id string, chat_id string, limit int, before int64, after int64, around int64) (structures.MessagesPage, error) {
 	key, _ := d.GetUsersKey(user_id, chat_id)
 	decrypted_key := security.PrivateKeyFromPEM(key)
 
-	messages, err := d.GetMessages(user_id, chat_id, limit, offset)
+	page, err := d.GetMessages(user_id, chat_id, limit, before, after, around)
 
-	for i := 0; i < len(messages); i++ {
-		messages[i].Text = security.Decrypt(messages[i].Text, decrypted_key)
+	for i := 0; i < len(page.Messages); i++ {
+		//Системные сообщения не шифруются
+		if page.Messages[i].System != "" {
+			continue
+		}
+		page.Messages[i].Text = security.Decrypt(page.Messages[i].Text, decrypted_key)
 	}
 
-	return messages, err
+	return page, err
 }
 
 //Метод авторизации, проверяет пользователя по логину и паролю, возвращая id
@@ -871,28 +1198,69 @@ func (d DatabaseInterface) Authorise(login string, password string) (string, err
 }
 
 //Метод отправки уже зашифрованных сообщений
-func (d DatabaseInterface) SendEncryptedMessage(chat_id string, user_id string, text []byte) (bool, error) {
+func (d DatabaseInterface) SendEncryptedMessage(chat_id string, user_id string, text []byte, replied_id string, client_id string) (structures.SentMessage, error) {
 	var msg structures.Message_noid
 
-	time := time.Now().UTC()
+	time := time.Now().UTC().Truncate(time.Millisecond)
 	objectId, _ := primitive.ObjectIDFromHex(chat_id)
 	msg.Chat_id = objectId
-	msg.Gtm_date = time.Format(DATE_FORMAT)
+	msg.Gtm_date = time
 
+	repliedId, err := d.checkSendPermission(user_id, objectId, replied_id)
+	if err != nil {
+		return structures.SentMessage{}, err
+	}
+	msg.Replied_id = repliedId
 	if !d.ChatIsSecured(chat_id) {
-		return false, errors.New("chat is not secured")
+		return structures.SentMessage{}, errors.New("chat is not secured")
 	}
 
 	msg.Text = text
 	userId, _ := primitive.ObjectIDFromHex(user_id)
 	msg.User_id = userId
+	msg.Client_id = client_id
+
+	return d.insertMessage(msg)
+}
+
+//Ищем уже отправленное сообщение по id клиента
+func (d DatabaseInterface) findSentMessage(msg structures.Message_noid) (structures.SentMessage, bool) {
+	var res structures.Message
+	err := d.collectionMessages.FindOne(
+		context.TODO(),
+		bson.D{{Key: "chat_id", Value: msg.Chat_id}, {Key: "user_id", Value: msg.User_id}, {Key: "client_id", Value: msg.Client_id}},
+		options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "seq", Value: 1}}),
+	).Decode(&res)
+	if err != nil {
+		return structures.SentMessage{}, false
+	}
+	return structures.SentMessage{Id: res.Id.Hex(), Seq: res.Seq, Duplicate: true}, true
+}
 
-	_, err := d.collectionMessages.InsertOne(context.TODO(), msg)
+//Сохраняем сообщение: выдаем номер, вставляем и добавляем в комментарии исходного
+//Если сообщение с тем же Client_id уже есть, возвращаем его без повторной вставки
+func (d DatabaseInterface) insertMessage(msg structures.Message_noid) (structures.SentMessage, error) {
+	if msg.Client_id != "" {
+		if sent, ok := d.findSentMessage(msg); ok {
+			return sent, nil
+		}
+	}
+
+	res, seq, err := d.insertWithSeq(msg)
+	if msg.Client_id != "" && mongo.IsDuplicateKeyError(err) {
+		//Параллельная повторная отправка успела раньше
+		if sent, ok := d.findSentMessage(msg); ok {
+			return sent, nil
+		}
+	}
 	if err != nil {
 		log.Println(err)
-		return false, err
+		return structures.SentMessage{}, err
 	}
-	return err == nil, err
+
+	err = d.pushComment(msg.Replied_id, res.InsertedID)
+	oid, _ := res.InsertedID.(primitive.ObjectID)
+	return structures.SentMessage{Id: oid.Hex(), Seq: seq}, err
 }
 
 func (d DatabaseInterface) getMessagesCount(chat_id string) int {
@@ -920,23 +1288,30 @@ func (d DatabaseInterface) getMessagesCount(chat_id string) int {
 	return -1
 }
 
-//Метод отправки сообщений
-func (d DatabaseInterface) SendMessage(chat_id string, user_id string, text string) (bool, error) {
-	time := time.Now().UTC()
+//Метод отправки сообщений, возвращает id и номер сообщения
+//Если передан replied_id, сообщение является ответом (комментарием в канале)
+//client_id делает отправку идемпотентной: повтор с тем же id вернет уже отправленное сообщение
+func (d DatabaseInterface) SendMessage(chat_id string, user_id string, text string, replied_id string, client_id string) (structures.SentMessage, error) {
+	time := time.Now().UTC().Truncate(time.Millisecond)
 	var msg structures.Message_noid
 	var byte_text []byte
 	objectId, _ := primitive.ObjectIDFromHex(chat_id)
 	msg.Chat_id = objectId
-	msg.Gtm_date = time.Format(DATE_FORMAT)
+	msg.Gtm_date = time
+	repliedId, err := d.checkSendPermission(user_id, objectId, replied_id)
+	if err != nil {
+		return structures.SentMessage{}, err
+	}
+	msg.Replied_id = repliedId
 	if d.ChatIsSecured(chat_id) {
 		if len(text) > SECURED_MESSAGE_LIMIT {
-			return false, errors.New("message length more than limit")
+			return structures.SentMessage{}, ErrMessageTooLong
 		}
 
 		key, e := d.GetUsersKey(user_id, chat_id)
 		if e != nil {
 			log.Println(e)
-			return false, e
+			return structures.SentMessage{}, e
 		}
 
 		decodedKey := security.PrivateKeyFromPEM(key)
@@ -944,28 +1319,91 @@ func (d DatabaseInterface) SendMessage(chat_id string, user_id string, text stri
 		byte_text = security.Encrypt(text, &decodedKey.PublicKey)
 	} else {
 		byte_text = []byte(text)
+		msg.Search_text = text
 	}
 
 	msg.Text = byte_text
 	userId, _ := primitive.ObjectIDFromHex(user_id)
 	msg.User_id = userId
+	msg.Client_id = client_id
+
+	return d.insertMessage(msg)
+}
 
-	_, err := d.collectionMessages.InsertOne(context.TODO(), msg)
+//Добавляем ответ в список комментариев исходного сообщения
+func (d DatabaseInterface) pushComment(replied_id primitive.ObjectID, comment_id interface{}) error {
+	if replied_id.IsZero() {
+		return nil
+	}
+	_, err := d.collectionMessages.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: replied_id}},
+		//В старых сообщениях comments_array может быть null
+		bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "comments_array", Value: bson.D{{Key: "$concatArrays", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$comments_array", bson.A{}}}},
+			bson.A{comment_id},
+		}}}}}}}},
+	)
 	if err != nil {
 		log.Println(err)
-		return false, err
 	}
-	return err == nil, err
+	return err
+}
+
+//Удаляем сообщение
+//Свое сообщение может удалить автор, чужое - участник с правом удаления сообщений
+//Возвращает id чата сообщения
+func (d DatabaseInterface) DeleteMessage(user_id string, message_id string) (string, error) {
+	var msg structures.Message
+	messageId, err := primitive.ObjectIDFromHex(message_id)
+	if err != nil {
+		return "", errors.New("invalid message_id")
+	}
+
+	err = d.collectionMessages.FindOne(context.TODO(), bson.D{{Key: "_id", Value: messageId}}).Decode(&msg)
+	if err != nil {
+		return "", errors.New("message not found")
+	}
+	chat_id := msg.Chat_id.Hex()
+
+	if !d.UserInChat(user_id, chat_id) {
+		return "", errors.New("user not in chat")
+	}
+	if msg.User_id.Hex() != user_id && !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_DELETE_MESSAGES) {
+		return "", errors.New("not enough permissions to delete others' messages")
+	}
+
+	_, err = d.collectionMessages.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: messageId}})
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	if !msg.Replied_id.IsZero() {
+		_, err = d.collectionMessages.UpdateOne(
+			context.TODO(),
+			bson.D{{Key: "_id", Value: msg.Replied_id}},
+			bson.D{{Key: "$pull", Value: bson.D{{Key: "comments_array", Value: messageId}}}},
+		)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return chat_id, nil
 }
 
 //Метод создания настроек чата
 func (d DatabaseInterface) insertChatSettings(
+	ctx context.Context,
+	undo *undoLog,
 	chat_id string,
 	secured bool,
 	search_visible bool,
 	resend bool,
 	users_write_permission bool,
 	personal bool,
+	channel bool,
 ) (*mongo.InsertOneResult, error) {
 	var f structures.Chat_settings_noid
 	chatId, _ := primitive.ObjectIDFromHex(chat_id)
@@ -975,18 +1413,163 @@ func (d DatabaseInterface) insertChatSettings(
 	f.Resend = resend && !f.Secured                               //Если чат защищен, то запрещаем пересылку
 	f.Users_write_permission = users_write_permission || personal //В персональном чате все могут писать
 	f.Personal = personal
+	f.Channel = channel && !personal //В канале пишут только администраторы
+	if f.Channel {
+		f.Users_write_permission = false
+	}
 
-	res, err := d.collectionChatSettings.InsertOne(context.TODO(), f)
+	res, err := d.collectionChatSettings.InsertOne(ctx, f)
 	if err != nil {
 		log.Println(err)
 		return res, err
 	}
+	undo.push(func(ctx context.Context) error {
+		_, err := d.collectionChatSettings.DeleteOne(ctx, bson.D{{Key: "_id", Value: res.InsertedID}})
+		return err
+	})
 
 	return res, err
 }
 
+//Изменение профиля и настроек чата, nil параметры не меняются
+//Сохраняются инварианты insertChatSettings, шифрование чата изменить нельзя
+//Логотип сохраняется только после проверки прав
+//Возвращает список измененных полей
+func (d DatabaseInterface) UpdateChat(
+	user_id string,
+	chat_id string,
+	name *string,
+	description *string,
+	logo []byte,
+	logo_url *string,
+	secured *bool,
+	search_visible *bool,
+	resend *bool,
+	users_write_permission *bool,
+) ([]string, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return nil, errors.New("invalid chat_id")
+	}
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return nil, errors.New("chat not found")
+	}
+	if settings.Personal {
+		return nil, errors.New("personal chat can't be changed")
+	}
+	//Старые сообщения открытого чата не зашифрованы, а у участников нет ключей
+	if secured != nil && *secured != settings.Secured {
+		return nil, errors.New("chat encryption can't be changed")
+	}
+
+	var changed []string
+
+	profile := bson.D{}
+	if name != nil {
+		if *name == "" {
+			return nil, errors.New("empty chat name")
+		}
+		profile = append(profile, bson.E{Key: "chat_name", Value: *name})
+		changed = append(changed, "name")
+	}
+	if description != nil {
+		profile = append(profile, bson.E{Key: "description", Value: *description})
+		changed = append(changed, "description")
+	}
+	if logo != nil {
+		changed = append(changed, "logo")
+	}
+
+	chatOptions := bson.D{}
+	if search_visible != nil {
+		chatOptions = append(chatOptions, bson.E{Key: "search_visible", Value: *search_visible})
+		changed = append(changed, "search_visible")
+	}
+	if resend != nil {
+		if *resend && settings.Secured {
+			return nil, errors.New("resend is forbidden in secured chat")
+		}
+		chatOptions = append(chatOptions, bson.E{Key: "resend", Value: *resend})
+		changed = append(changed, "resend")
+	}
+	if users_write_permission != nil {
+		if *users_write_permission && settings.Channel {
+			return nil, errors.New("only admins can write in channel")
+		}
+		chatOptions = append(chatOptions, bson.E{Key: "users_write_permission", Value: *users_write_permission})
+		changed = append(changed, "users_write_permission")
+	}
+
+	if len(changed) == 0 {
+		return nil, errors.New("nothing to change")
+	}
+	if !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_CHANGE_INFO) {
+		return nil, errors.New("not enough permissions to change chat")
+	}
+
+	var logoId primitive.ObjectID
+	if logo != nil {
+		//TODO процесс преобразования файла и его сохранение в директорию files
+		id, err := d.CreateFile(user_id, logo, logo_url)
+		if err != nil {
+			return nil, err
+		}
+		logoId, err = primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+		profile = append(profile, bson.E{Key: "chat_logo", Value: logoId})
+	}
+
+	//Профиль и настройки меняются вместе
+	var oldLogo interface{}
+	err = d.runAtomic(func(ctx context.Context, undo *undoLog) error {
+		if len(profile) > 0 {
+			old, err := setWithUndo(ctx, undo, &d.collectionChats, chatId, profile)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+			oldLogo = old["chat_logo"]
+		}
+
+		if len(chatOptions) > 0 {
+			_, err := setWithUndo(ctx, undo, &d.collectionChatSettings, settings.Id, chatOptions)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		//Логотип так и не попал в чат
+		if logo != nil {
+			d.collectionFiles.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: logoId}})
+		}
+		return nil, err
+	}
+
+	//Прошлый логотип больше не нужен
+	if oldId, ok := oldLogo.(primitive.ObjectID); logo != nil && ok && !oldId.IsZero() {
+		_, err = d.collectionFiles.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: oldId}})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	//Изменения уже применены, ошибка системного сообщения только логируется
+	d.insertSystemMessage(chatId, userId, structures.SYSTEM_CHAT_UPDATED, strings.Join(changed, ","))
+	return changed, nil
+}
+
 //Добавляем чат в список пользователя
 func (d DatabaseInterface) pushUsersChats(
+	ctx context.Context,
+	undo *undoLog,
 	user_id string,
 	chat_element_id string,
 ) (bool, error) {
@@ -998,17 +1581,31 @@ func (d DatabaseInterface) pushUsersChats(
 		}},
 	}
 
+	elementId := objectId
 	objectId, err := primitive.ObjectIDFromHex(user_id)
 	if err != nil {
 		return false, errors.New("invalid user's id")
 	}
-	_, err = d.collectionUsers.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: objectId}}, update)
+	_, err = d.collectionUsers.UpdateOne(ctx, bson.D{{Key: "_id", Value: objectId}}, update)
+	if err == nil {
+		userId := objectId
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionUsers.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: userId}},
+				bson.D{{Key: "$pull", Value: bson.D{{Key: "chats_array", Value: elementId}}}},
+			)
+			return err
+		})
+	}
 
-	return err != nil, err
+	return err == nil, err
 }
 
 //Метод создания элемента чата пользователя
 func (d DatabaseInterface) insertUsersChatsArray(
+	ctx context.Context,
+	undo *undoLog,
 	user_id string,
 	chat_id string,
 	privateKey *rsa.PrivateKey,
@@ -1024,13 +1621,17 @@ func (d DatabaseInterface) insertUsersChatsArray(
 	f.Personal = personal
 	f.Secured = secured || personal
 
-	res, err := d.collectionChatsArray.InsertOne(context.TODO(), f)
+	res, err := d.collectionChatsArray.InsertOne(ctx, f)
 	if err != nil {
 		log.Println(err)
 		return "", err
 	}
+	undo.push(func(ctx context.Context) error {
+		_, err := d.collectionChatsArray.DeleteOne(ctx, bson.D{{Key: "_id", Value: res.InsertedID}})
+		return err
+	})
 	oid, _ := res.InsertedID.(primitive.ObjectID)
-	res2, err2 := d.pushUsersChats(user_id, oid.Hex())
+	res2, err2 := d.pushUsersChats(ctx, undo, user_id, oid.Hex())
 	if !res2 {
 		log.Println(err2)
 		return "", err2
@@ -1040,11 +1641,16 @@ func (d DatabaseInterface) insertUsersChatsArray(
 }
 
 //Метод вычисляет есть ли персональный чат у двух пользователей
+//Чаты, созданные до появления ключа пары, ищутся по участникам
 func (d DatabaseInterface) hasPersonalChat(first_id string, second_id string) (bool, string) {
 	var res []structures.ID
 	firstId, _ := primitive.ObjectIDFromHex(first_id)
 	secondId, _ := primitive.ObjectIDFromHex(second_id)
 
+	if id, ok := d.findPersonalChat(personalPairKey(firstId, secondId)); ok {
+		return true, id
+	}
+
 	cur, err := (d.collectionChats.Aggregate(context.TODO(), mongo.Pipeline{
 		bson.D{{Key: "$match", Value: bson.D{{Key: "users_array", Value: firstId}}}},
 		bson.D{{Key: "$match", Value: bson.D{{Key: "users_array", Value: secondId}}}},
@@ -1088,9 +1694,11 @@ func (d DatabaseInterface) hasPersonalChat(first_id string, second_id string) (b
 }
 
 //Метод создания чата
+//Возвращает id чата и признак создания: для существующего персонального чата пары - false
 func (d DatabaseInterface) CreateChat(
 	user_id string,
 	name string,
+	description string,
 	logo string,
 	users []string,
 	privateKey rsa.PrivateKey,
@@ -1100,22 +1708,31 @@ func (d DatabaseInterface) CreateChat(
 	resend bool,
 	users_write_permission bool,
 	personal bool,
-) (string, error) {
+	channel bool,
+) (string, bool, error) {
+	var f structures.Chat_noid
 	if personal {
 		if len(users) != 1 {
-			return "", errors.New("wrong users length. Must be 1")
+			return "", false, errors.New("wrong users length. Must be 1")
 		}
 		ok, id := d.hasPersonalChat(user_id, users[0])
 		if ok {
-			return id, nil
+			return id, false, nil
 		}
+		firstId, _ := primitive.ObjectIDFromHex(user_id)
+		secondId, err := primitive.ObjectIDFromHex(users[0])
+		if err != nil || firstId == secondId {
+			return "", false, errors.New("invalid user's id")
+		}
+		f.Pair_key = personalPairKey(firstId, secondId)
 	}
 
-	var f structures.Chat_noid
 	f.Chat_name = name
+	f.Description = description
 	logoId, _ := primitive.ObjectIDFromHex(logo)
 	f.Chat_logo = logoId
 	userId, _ := primitive.ObjectIDFromHex(user_id)
+	f.Owner_id = userId
 	var ar []primitive.ObjectID
 	f.Admins_array = append(ar, userId)
 	//Если зашифрованный или персональный чат, то шифруем
@@ -1135,56 +1752,129 @@ func (d DatabaseInterface) CreateChat(
 	f.Users_array = arr
 
 	f.Files_array = []primitive.ObjectID{}
-	f.Invited_array = []primitive.ObjectID{}
-	f.Banned_array = []primitive.ObjectID{}
+	f.Invited_array = []structures.Invitation{}
+	f.Banned_array = []structures.Ban{}
+	f.Roles = []structures.Role{}
+	f.Members_roles = []structures.Member_role{}
+
+	var chatId primitive.ObjectID
+	//Чат, настройки и записи участников создаются вместе, частичный чат не остается
+	err := d.runAtomic(func(ctx context.Context, undo *undoLog) error {
+		res, err := d.collectionChats.InsertOne(ctx, f)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		chatId, _ = res.InsertedID.(primitive.ObjectID)
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.DeleteOne(ctx, bson.D{{Key: "_id", Value: chatId}})
+			return err
+		})
+
+		//Создаем элемент настроек чата
+		res_settings, err := d.insertChatSettings(
+			ctx,
+			undo,
+			chatId.Hex(),
+			secured,
+			search_visible,
+			resend,
+			users_write_permission,
+			personal,
+			channel,
+		)
+		if err != nil {
+			return err
+		}
 
-	res, err := d.collectionChats.InsertOne(context.TODO(), f)
+		//Добавляем чат пользователю
+		for i := 0; i < len(f.Users_array); i++ {
+			_, err = d.insertUsersChatsArray(
+				ctx,
+				undo,
+				f.Users_array[i].Hex(),
+				chatId.Hex(),
+				&privateKey,
+				personal,
+				secured,
+			)
+			if err != nil {
+				return err
+			}
+		}
 
+		_, err = d.collectionChats.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: chatId}},
+			bson.D{
+				{Key: "$set", Value: bson.D{{Key: "options", Value: res_settings.InsertedID}}},
+			},
+		)
+		return err
+	})
+	//Персональный чат этой пары уже создан параллельным запросом
+	if f.Pair_key != "" && mongo.IsDuplicateKeyError(err) {
+		if id, ok := d.findPersonalChat(f.Pair_key); ok {
+			return id, false, nil
+		}
+	}
 	if err != nil {
 		log.Println(err)
-		return "", err
+		return "", false, err
 	}
-	//Создаем элемент настроек чата
-	oid, _ := res.InsertedID.(primitive.ObjectID)
-	res_settings, err := d.insertChatSettings(
-		oid.Hex(),
-		secured,
-		search_visible,
-		resend,
-		users_write_permission,
-		personal,
-	)
-	//Добавляем чат пользователю
-	for i := 0; i < len(f.Users_array); i++ {
-		_, err = d.insertUsersChatsArray(
-			f.Users_array[i].Hex(),
-			oid.Hex(),
-			&privateKey,
-			personal,
-			secured,
-		)
+
+	return chatId.Hex(), true, nil
+}
+
+//Получаем список заблокированных пользователем
+func (d DatabaseInterface) getBlocked(user_id primitive.ObjectID) []primitive.ObjectID {
+	var res structures.User
+	err := d.collectionUsers.FindOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: user_id}},
+		options.FindOne().SetProjection(bson.D{{Key: "blocked_array", Value: 1}}),
+	).Decode(&res)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return res.Blocked_array
+}
+
+//Блокируем или разблокируем пользователя
+func (d DatabaseInterface) SetUserBlocked(user_id string, blocked_id string, blocked bool) error {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return errors.New("invalid user's id")
+	}
+	blockedId, err := primitive.ObjectIDFromHex(blocked_id)
+	if err != nil || blockedId == userId {
+		return errors.New("invalid blocked user's id")
 	}
 
-	d.collectionChats.UpdateOne(
+	operator := "$pull"
+	if blocked {
+		operator = "$addToSet"
+	}
+
+	_, err = d.collectionUsers.UpdateOne(
 		context.TODO(),
-		bson.M{"_id": res.InsertedID},
-		bson.D{
-			{Key: "$set", Value: bson.D{{Key: "options", Value: res_settings.InsertedID}}},
-		},
+		bson.D{{Key: "_id", Value: userId}},
+		bson.D{{Key: operator, Value: bson.D{{Key: "blocked_array", Value: blockedId}}}},
 	)
-	oids, _ := res.InsertedID.(primitive.ObjectID)
-	return oids.Hex(), err
+
+	return err
 }
 
 //Метод сохранения файла и добавления записи в бд
 func (d DatabaseInterface) CreateFile(user_id string, file []byte, url *string) (string, error) {
 	var err error
 	var f structures.Files_noid
-	tm := time.Now().UTC()
+	tm := time.Now().UTC().Truncate(time.Millisecond)
 	f.Name = "name"
 	f.Type = "type"
-	f.Gtm_date = tm.Format(DATE_FORMAT)
-	f.ExpiredAt = tm.AddDate(0, 6, 0).Format(DATE_FORMAT)
+	f.Gtm_date = structures.Date(tm)
+	f.ExpiredAt = structures.Date(tm.AddDate(0, 6, 0))
 	f.Message_id = nil
 	if url != nil {
 		f.Url = *url
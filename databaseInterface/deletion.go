@@ -0,0 +1,241 @@
+package databaseInterface
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Размер пачки сообщений при удалении вложений
+const DELETE_BATCH = 1000
+
+//Пауза перед повтором прерванного удаления чата, удваивается до DELETE_RETRY_MAX
+const DELETE_RETRY_MIN = time.Second
+const DELETE_RETRY_MAX = 10 * time.Minute
+
+//Удаление чата владельцем
+//Чат помечается удаляемым, данные чистит фоновая задача, которую можно возобновить после перезапуска
+//Возвращает id участников, которых нужно уведомить
+func (d DatabaseInterface) DeleteChat(user_id string, chat_id string) ([]string, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return nil, errors.New("invalid chat_id")
+	}
+
+	if !d.UserIsOwner(user_id, chat_id) {
+		return nil, errors.New("only owner can delete chat")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return nil, errors.New("chat not found")
+	}
+	if settings.Personal {
+		return nil, errors.New("personal chat is deleted as conversation")
+	}
+
+	var chat structures.Chat
+	err = d.collectionChats.FindOneAndUpdate(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}, {Key: "deleting", Value: bson.D{{Key: "$ne", Value: true}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "deleting", Value: true}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&chat)
+	if err != nil {
+		return nil, errors.New("chat is already being deleted")
+	}
+
+	var members []string
+	for i := 0; i < len(chat.Users_array); i++ {
+		members = append(members, chat.Users_array[i].Hex())
+	}
+
+	go d.runChatDeletion(chat)
+
+	return members, nil
+}
+
+//Возобновляем удаление чатов, прерванное перезапуском сервера
+func (d DatabaseInterface) ResumeChatDeletions() {
+	cur, err := d.collectionChats.Find(context.TODO(), bson.D{{Key: "deleting", Value: true}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var chats []structures.Chat
+	err = cur.All(context.TODO(), &chats)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := 0; i < len(chats); i++ {
+		go d.runChatDeletion(chats[i])
+	}
+}
+
+//Удаляем данные чата, пока не получится
+//Шаги идемпотентны, поэтому после ошибки удаление повторяется целиком с нарастающей паузой
+//Если сервер остановится, чат останется помеченным и удалится при следующем запуске
+func (d DatabaseInterface) runChatDeletion(chat structures.Chat) {
+	log.Println("Deleting chat " + chat.Id.Hex())
+	delay := DELETE_RETRY_MIN
+	for {
+		err := d.deleteChatData(&chat)
+		if err == nil {
+			return
+		}
+		log.Println("Chat deletion interrupted " + chat.Id.Hex() + ", retry in " + delay.String())
+		log.Println(err)
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > DELETE_RETRY_MAX {
+			delay = DELETE_RETRY_MAX
+		}
+	}
+}
+
+//Удаляем чат со всеми связанными данными: записями Chats_array, ссылками у пользователей,
+//файлами, сообщениями и настройками
+//Каждый шаг идемпотентен, сам чат удаляется последним, поэтому удаление можно повторить
+func (d DatabaseInterface) deleteChatData(chat *structures.Chat) error {
+	err := d.deleteChatsArrayEntries(chat.Id)
+	if err != nil {
+		return err
+	}
+
+	err = d.deleteMessagesFiles(chat.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.collectionMessages.DeleteMany(context.TODO(), bson.D{{Key: "chat_id", Value: chat.Id}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	files := append([]primitive.ObjectID{}, chat.Files_array...)
+	if !chat.Chat_logo.IsZero() {
+		files = append(files, chat.Chat_logo)
+	}
+	if len(files) > 0 {
+		_, err = d.collectionFiles.DeleteMany(context.TODO(), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: files}}}})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	_, err = d.collectionChatSettings.DeleteMany(context.TODO(), bson.D{{Key: "chat_id", Value: chat.Id}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = d.collectionChats.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: chat.Id}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	//Вступление, начатое до пометки чата удаляемым, могло добавить записи после первой очистки
+	return d.deleteChatsArrayEntries(chat.Id)
+}
+
+//Удаляем записи Chats_array чата и ссылки на них у пользователей
+//Удаляются только найденные записи, чтобы не оставить ссылок на записи, добавленные в процессе
+func (d DatabaseInterface) deleteChatsArrayEntries(chat_id primitive.ObjectID) error {
+	cur, err := d.collectionChatsArray.Find(context.TODO(), bson.D{{Key: "chat_id", Value: chat_id}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	var elems []structures.Chats_array
+	err = cur.All(context.TODO(), &elems)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	ids := []primitive.ObjectID{}
+	for i := 0; i < len(elems); i++ {
+		ids = append(ids, elems[i].Id)
+	}
+
+	_, err = d.collectionUsers.UpdateMany(
+		context.TODO(),
+		bson.D{{Key: "chats_array", Value: bson.D{{Key: "$in", Value: ids}}}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "chats_array", Value: bson.D{{Key: "$in", Value: ids}}}}}},
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = d.collectionChatsArray.DeleteMany(context.TODO(), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+//Удаляем файлы сообщений чата пачками, у обработанных сообщений чистим files_array
+func (d DatabaseInterface) deleteMessagesFiles(chat_id primitive.ObjectID) error {
+	filter := bson.D{
+		{Key: "chat_id", Value: chat_id},
+		{Key: "files_array.0", Value: bson.D{{Key: "$exists", Value: true}}},
+	}
+
+	for {
+		cur, err := d.collectionMessages.Find(
+			context.TODO(),
+			filter,
+			options.Find().SetLimit(DELETE_BATCH).SetProjection(bson.D{{Key: "files_array", Value: 1}}),
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		var messages []structures.Message
+		err = cur.All(context.TODO(), &messages)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		var files, ids []primitive.ObjectID
+		for i := 0; i < len(messages); i++ {
+			files = append(files, messages[i].Files_array...)
+			ids = append(ids, messages[i].Id)
+		}
+
+		_, err = d.collectionFiles.DeleteMany(context.TODO(), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: files}}}})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		_, err = d.collectionMessages.UpdateMany(
+			context.TODO(),
+			bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "files_array", Value: bson.A{}}}}},
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package databaseInterface
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Сколько раз повторяем запись события при гонке за номер
+const EVENT_APPEND_RETRIES = 5
+
+//Журнал событий вебсокета в Mongo, переживает перезапуск сервера
+//В каждом потоке хранятся последние size событий
+type MongoEventStore struct {
+	collection mongo.Collection
+	size       int64
+}
+
+//Создаем журнал событий в коллекции coll_events
+func (d DatabaseInterface) NewEventStore(coll_events string, size int) *MongoEventStore {
+	s := &MongoEventStore{
+		collection: *d.database.Collection(coll_events),
+		size:       int64(size),
+	}
+
+	_, err := s.collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "stream", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return s
+}
+
+//Номер последнего события потока, 0 - поток пуст
+func (s *MongoEventStore) lastSeq(stream string) (int64, error) {
+	var res structures.StoredEvent
+	err := s.collection.FindOne(
+		context.TODO(),
+		bson.D{{Key: "stream", Value: stream}},
+		options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(bson.D{{Key: "seq", Value: 1}}),
+	).Decode(&res)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return res.Seq, err
+}
+
+//Добавляем событие со следующим номером
+//Номер уникален в потоке, при гонке с другим сервером запись повторяется
+func (s *MongoEventStore) Append(stream string, encode func(seq int64) []byte) (int64, error) {
+	for i := 0; i < EVENT_APPEND_RETRIES; i++ {
+		last, err := s.lastSeq(stream)
+		if err != nil {
+			return 0, err
+		}
+
+		seq := last + 1
+		_, err = s.collection.InsertOne(context.TODO(), structures.StoredEvent{
+			Stream: stream,
+			Seq:    seq,
+			Data:   encode(seq),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		//Последнее событие всегда остается, поэтому нумерация не сбрасывается
+		if seq > s.size {
+			_, err = s.collection.DeleteMany(context.TODO(), bson.D{
+				{Key: "stream", Value: stream},
+				{Key: "seq", Value: bson.D{{Key: "$lte", Value: seq - s.size}}},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return seq, nil
+	}
+	return 0, errors.New("can't append event to " + stream)
+}
+
+func (s *MongoEventStore) Since(stream string, after int64) ([][]byte, bool, error) {
+	last, err := s.lastSeq(stream)
+	if err != nil {
+		return nil, false, err
+	}
+	if after > last {
+		return nil, false, nil
+	}
+	if after == last {
+		return nil, true, nil
+	}
+
+	cur, err := s.collection.Find(
+		context.TODO(),
+		bson.D{{Key: "stream", Value: stream}, {Key: "seq", Value: bson.D{{Key: "$gt", Value: after}}}},
+		options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	var events []structures.StoredEvent
+	err = cur.All(context.TODO(), &events)
+	if err != nil {
+		return nil, false, err
+	}
+
+	//Начало разрыва уже удалено из журнала
+	if len(events) == 0 || events[0].Seq != after+1 {
+		return nil, false, nil
+	}
+
+	res := make([][]byte, len(events))
+	for i := 0; i < len(events); i++ {
+		res[i] = events[i].Data
+	}
+	return res, true, nil
+}
+
+func (s *MongoEventStore) Drop(stream string) error {
+	_, err := s.collection.DeleteMany(context.TODO(), bson.D{{Key: "stream", Value: stream}})
+	return err
+}
@@ -0,0 +1,1017 @@
+package databaseInterface
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	security "github.com/MUR4SH/MyMessenger/security"
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Время жизни приглашения в чат
+const INVITATION_TTL = 7 * 24 * time.Hour
+
+//Получаем ключ чата из записи любого участника
+func (d DatabaseInterface) getChatPrivateKey(chat_id primitive.ObjectID) (*rsa.PrivateKey, error) {
+	var elem structures.Chats_array
+	err := d.collectionChatsArray.FindOne(context.TODO(), bson.D{{Key: "chat_id", Value: chat_id}}).Decode(&elem)
+	if err != nil {
+		return nil, err
+	}
+
+	key := security.PrivateKeyFromPEM(elem.Key)
+	if key == nil {
+		return nil, errors.New("invalid chat key")
+	}
+
+	return key, nil
+}
+
+//Проверяем является ли пользователь администратором чата
+//Статус берется из роли участника, владелец тоже считается администратором
+func (d DatabaseInterface) UserIsAdmin(user_id string, chat_id string) bool {
+	role := d.UserRole(user_id, chat_id)
+	return role == ROLE_ADMIN || role == ROLE_OWNER
+}
+
+//Проверяем является ли пользователь владельцем чата
+func (d DatabaseInterface) UserIsOwner(user_id string, chat_id string) bool {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return false
+	}
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return false
+	}
+
+	count, err := d.collectionChats.CountDocuments(context.TODO(), bson.D{
+		{Key: "_id", Value: chatId},
+		{Key: "owner_id", Value: userId},
+	})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return count > 0
+}
+
+//Получаем документ чата без ключа
+func (d DatabaseInterface) getChatDocument(chat_id primitive.ObjectID) (structures.Chat, error) {
+	var res structures.Chat
+	err := d.collectionChats.FindOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chat_id}},
+		options.FindOne().SetProjection(bson.D{{Key: "key", Value: 0}}),
+	).Decode(&res)
+
+	return res, err
+}
+
+//Добавляем пользователя в чат
+//Ключ у всех участников чата один, новый участник получает копию ключа
+//prepare выполняется первым шагом той же атомарной операции, может быть nil
+func (d DatabaseInterface) addChatMember(user_id string, chat_id string, settings *structures.Chat_settings, prepare func(ctx context.Context, undo *undoLog) error) (string, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return "", errors.New("invalid chat_id")
+	}
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return "", errors.New("invalid user's id")
+	}
+
+	if d.UserBanned(user_id, chat_id) {
+		return "", errors.New("user is banned")
+	}
+
+	if d.UserInChat(user_id, chat_id) {
+		return "", errors.New("user already in chat")
+	}
+
+	key, err := d.getChatPrivateKey(chatId)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	var res string
+	err = d.runAtomic(func(ctx context.Context, undo *undoLog) error {
+		if prepare != nil {
+			err := prepare(ctx, undo)
+			if err != nil {
+				return err
+			}
+		}
+
+		//В удаляемый чат вступить нельзя, проверка в фильтре не пропустит гонку с удалением
+		upd, err := d.collectionChats.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: chatId}, {Key: "deleting", Value: bson.D{{Key: "$ne", Value: true}}}},
+			bson.D{{Key: "$addToSet", Value: bson.D{{Key: "users_array", Value: userId}}}},
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		if upd.MatchedCount == 0 {
+			return errors.New("chat is being deleted")
+		}
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: chatId}},
+				bson.D{{Key: "$pull", Value: bson.D{{Key: "users_array", Value: userId}}}},
+			)
+			return err
+		})
+
+		res, err = d.insertUsersChatsArray(
+			ctx,
+			undo,
+			user_id,
+			chat_id,
+			key,
+			settings.Personal,
+			settings.Secured,
+		)
+		return err
+	})
+
+	return res, err
+}
+
+//Метод вступления в открытый чат из каталога
+func (d DatabaseInterface) JoinChat(user_id string, chat_id string) (string, error) {
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return "", errors.New("chat not found")
+	}
+	//Вступить можно только в чаты, видимые в поиске
+	if !settings.Search_visible || settings.Personal {
+		return "", errors.New("chat is not open")
+	}
+
+	return d.addChatMember(user_id, chat_id, settings, nil)
+}
+
+//Приглашаем пользователя в чат
+//Повторное приглашение заменяет предыдущее и продлевает срок
+func (d DatabaseInterface) InviteUser(user_id string, chat_id string, invited_id string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+	invitedId, err := primitive.ObjectIDFromHex(invited_id)
+	if err != nil {
+		return errors.New("invalid invited user's id")
+	}
+
+	if !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_INVITE) {
+		return errors.New("not enough permissions to invite")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return errors.New("chat not found")
+	}
+	if settings.Personal {
+		return errors.New("can't invite to personal chat")
+	}
+
+	if d.UserBanned(invited_id, chat_id) {
+		return errors.New("user is banned")
+	}
+
+	if d.UserInChat(invited_id, chat_id) {
+		return errors.New("user already in chat")
+	}
+
+	//Пользователь, заблокировавший приглашающего, недоступен для приглашения
+	blocked := d.getBlocked(invitedId)
+	for i := 0; i < len(blocked); i++ {
+		if blocked[i] == userId {
+			return errors.New("user is not available")
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	invitation := structures.Invitation{
+		User_id:    invitedId,
+		Inviter_id: userId,
+		Gtm_date:   structures.Date(now),
+		ExpiredAt:  structures.Date(now.Add(INVITATION_TTL)),
+	}
+
+	//Одним обновлением убираем прошлое приглашение пользователя и все истекшие и добавляем новое
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		mongo.Pipeline{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "invited_array", Value: bson.D{
+				{Key: "$concatArrays", Value: bson.A{
+					bson.D{{Key: "$filter", Value: bson.D{
+						{Key: "input", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$invited_array", bson.A{}}}}},
+						{Key: "cond", Value: bson.D{{Key: "$and", Value: bson.A{
+							bson.D{{Key: "$ne", Value: bson.A{"$$this.user_id", invitedId}}},
+							bson.D{{Key: "$gt", Value: bson.A{"$$this.expiredat", now}}},
+						}}}},
+					}}},
+					bson.D{{Key: "$literal", Value: bson.A{invitation}}},
+				}},
+			}}}}},
+		},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return err
+}
+
+//Получаем действующие приглашения пользователя
+func (d DatabaseInterface) GetInvitations(user_id string) ([]structures.Invitation_lite, error) {
+	var res []structures.Invitation_lite
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return nil, errors.New("invalid user's id")
+	}
+
+	now := time.Now().UTC()
+	active := bson.D{
+		{Key: "user_id", Value: userId},
+		{Key: "expiredat", Value: bson.D{{Key: "$gt", Value: now}}},
+	}
+
+	cur, err := d.collectionChats.Aggregate(context.TODO(), mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "invited_array", Value: bson.D{{Key: "$elemMatch", Value: active}}}}}},
+		bson.D{{Key: "$unwind", Value: "$invited_array"}},
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "invited_array.user_id", Value: userId},
+			{Key: "invited_array.expiredat", Value: bson.D{{Key: "$gt", Value: now}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 1},
+			{Key: "chat_name", Value: 1},
+			{Key: "chat_logo", Value: 1},
+			{Key: "inviter_id", Value: "$invited_array.inviter_id"},
+			{Key: "gtm_date", Value: "$invited_array.gtm_date"},
+			{Key: "expiredat", Value: "$invited_array.expiredat"},
+		}}},
+		bson.D{{
+			Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: "Files"},
+				{Key: "localField", Value: "chat_logo"},
+				{Key: "foreignField", Value: "_id"},
+				{Key: "as", Value: "chat_logo"},
+				{Key: "pipeline", Value: []bson.D{
+					{{
+						Key: "$project", Value: bson.D{
+							{Key: "url", Value: 1},
+						},
+					}},
+				}},
+			},
+		}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "gtm_date", Value: -1}}}},
+	})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	for cur.Next(context.TODO()) {
+		var elem structures.Invitation_lite
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		res = append(res, elem)
+	}
+
+	return res, nil
+}
+
+//Убираем действующее приглашение пользователя и возвращаем его, nil - приглашения не было
+func (d DatabaseInterface) pullInvitation(ctx context.Context, user_id primitive.ObjectID, chat_id primitive.ObjectID) (*structures.Invitation, error) {
+	var res struct {
+		Invited_array []structures.Invitation
+	}
+	err := d.collectionChats.FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{Key: "_id", Value: chat_id},
+			{Key: "invited_array", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+				{Key: "user_id", Value: user_id},
+				{Key: "expiredat", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}},
+			}}}},
+		},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "invited_array", Value: bson.D{{Key: "user_id", Value: user_id}}}}}},
+		options.FindOneAndUpdate().SetProjection(bson.D{
+			{Key: "invited_array", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "user_id", Value: user_id}}}}},
+		}),
+	).Decode(&res)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if len(res.Invited_array) == 0 {
+		return nil, nil
+	}
+
+	return &res.Invited_array[0], nil
+}
+
+//Принимаем приглашение в чат
+func (d DatabaseInterface) AcceptInvitation(user_id string, chat_id string) (string, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return "", errors.New("invalid chat_id")
+	}
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return "", errors.New("invalid user's id")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return "", errors.New("chat not found")
+	}
+
+	//Приглашение убирается в одной операции с добавлением участника,
+	//чтобы при ошибке пользователь мог принять его повторно
+	return d.addChatMember(user_id, chat_id, settings, func(ctx context.Context, undo *undoLog) error {
+		invitation, err := d.pullInvitation(ctx, userId, chatId)
+		if err != nil {
+			return err
+		}
+		if invitation == nil {
+			return errors.New("invitation not found or expired")
+		}
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: chatId}},
+				bson.D{{Key: "$push", Value: bson.D{{Key: "invited_array", Value: invitation}}}},
+			)
+			return err
+		})
+		return nil
+	})
+}
+
+//Отклоняем приглашение в чат
+func (d DatabaseInterface) DeclineInvitation(user_id string, chat_id string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return errors.New("invalid user's id")
+	}
+
+	invitation, err := d.pullInvitation(context.TODO(), userId, chatId)
+	if err != nil {
+		return err
+	}
+	if invitation == nil {
+		return errors.New("invitation not found or expired")
+	}
+
+	return nil
+}
+
+//Условие действующего бана пользователя
+func activeBan(user_id primitive.ObjectID) bson.D {
+	return bson.D{
+		{Key: "user_id", Value: user_id},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expiredat", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "expiredat", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}}},
+		}},
+	}
+}
+
+//Проверяем забанен ли пользователь в чате
+func (d DatabaseInterface) UserBanned(user_id string, chat_id string) bool {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return false
+	}
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return false
+	}
+
+	count, err := d.collectionChats.CountDocuments(context.TODO(), bson.D{
+		{Key: "_id", Value: chatId},
+		{Key: "banned_array", Value: bson.D{{Key: "$elemMatch", Value: activeBan(userId)}}},
+	})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return count > 0
+}
+
+//Удаляем пользователя из чата
+//Чистим участников чата, запись Chats_array и ссылку на нее у пользователя
+//Если уходит владелец, владение переходит к другому участнику, а если уходит последний участник - чат удаляется
+func (d DatabaseInterface) removeMember(user_id primitive.ObjectID, chat_id primitive.ObjectID) error {
+	var chat *structures.Chat
+	err := d.runAtomic(func(ctx context.Context, undo *undoLog) error {
+		var err error
+		chat, err = d.removeMemberSteps(ctx, undo, user_id, chat_id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	//Удаление запускаем после фиксации, чтобы не удалять данные отмененной операции
+	if chat != nil {
+		go d.runChatDeletion(*chat)
+	}
+	return nil
+}
+
+//Шаги удаления пользователя из чата для составных операций
+//Компенсации возвращают только этого пользователя, не затирая изменения других запросов
+//Если чат остался без участников, возвращает его для удаления
+func (d DatabaseInterface) removeMemberSteps(ctx context.Context, undo *undoLog, user_id primitive.ObjectID, chat_id primitive.ObjectID) (*structures.Chat, error) {
+	var chat structures.Chat
+	err := d.collectionChats.FindOne(ctx, bson.D{{Key: "_id", Value: chat_id}}).Decode(&chat)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	empty, err := d.passOwnership(ctx, undo, &chat, user_id)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var deleted *structures.Chat
+	if empty {
+		deleted = &chat
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: chat_id}},
+		bson.D{{Key: "$pull", Value: bson.D{
+			{Key: "users_array", Value: user_id},
+			{Key: "admins_array", Value: user_id},
+			{Key: "members_roles", Value: bson.D{{Key: "user_id", Value: user_id}}},
+		}}},
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	//Возвращаем пользователя и его роль
+	restore := bson.D{}
+	for i := 0; i < len(chat.Users_array); i++ {
+		if chat.Users_array[i] == user_id {
+			restore = append(restore, bson.E{Key: "users_array", Value: user_id})
+			break
+		}
+	}
+	for i := 0; i < len(chat.Admins_array); i++ {
+		if chat.Admins_array[i] == user_id {
+			restore = append(restore, bson.E{Key: "admins_array", Value: user_id})
+			break
+		}
+	}
+	for i := 0; i < len(chat.Members_roles); i++ {
+		if chat.Members_roles[i].User_id == user_id {
+			restore = append(restore, bson.E{Key: "members_roles", Value: chat.Members_roles[i]})
+			break
+		}
+	}
+	if len(restore) > 0 {
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: chat_id}},
+				bson.D{{Key: "$addToSet", Value: restore}},
+			)
+			return err
+		})
+	}
+
+	var elem bson.M
+	err = d.collectionChatsArray.FindOneAndDelete(ctx, bson.D{
+		{Key: "user_id", Value: user_id},
+		{Key: "chat_id", Value: chat_id},
+	}).Decode(&elem)
+	if err == mongo.ErrNoDocuments {
+		return deleted, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	undo.push(func(ctx context.Context) error {
+		_, err := d.collectionChatsArray.InsertOne(ctx, elem)
+		return err
+	})
+
+	_, err = d.collectionUsers.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: user_id}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "chats_array", Value: elem["_id"]}}}},
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return deleted, nil
+}
+
+//Баним пользователя в чате
+//duration - длительность бана, 0 - бессрочно
+func (d DatabaseInterface) BanUser(user_id string, chat_id string, banned_id string, reason string, duration time.Duration) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+	bannedId, err := primitive.ObjectIDFromHex(banned_id)
+	if err != nil || bannedId == userId {
+		return errors.New("invalid banned user's id")
+	}
+	if duration < 0 {
+		return errors.New("invalid duration")
+	}
+
+	if !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_BAN) {
+		return errors.New("not enough permissions to ban")
+	}
+	//Владельца забанить нельзя, администратора может забанить только владелец
+	if d.UserIsOwner(banned_id, chat_id) {
+		return errors.New("can't ban owner")
+	}
+	if d.UserIsAdmin(banned_id, chat_id) && !d.UserIsOwner(user_id, chat_id) {
+		return errors.New("only owner can ban admin")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return errors.New("chat not found")
+	}
+	if settings.Personal {
+		return errors.New("can't ban in personal chat")
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ban := structures.Ban{
+		User_id:   bannedId,
+		Banned_by: userId,
+		Reason:    reason,
+		Gtm_date:  structures.Date(now),
+	}
+	if duration > 0 {
+		expired := structures.Date(now.Add(duration))
+		ban.ExpiredAt = &expired
+	}
+
+	//Бан и удаление из чата - одна операция, иначе пользователь может остаться забаненным участником
+	return d.runAtomic(func(ctx context.Context, undo *undoLog) error {
+		//Прошлый бан и приглашение пользователя заменяются
+		var old struct {
+			Banned_array  []structures.Ban
+			Invited_array []structures.Invitation
+		}
+		err := d.collectionChats.FindOneAndUpdate(
+			ctx,
+			bson.D{{Key: "_id", Value: chatId}},
+			bson.D{{Key: "$pull", Value: bson.D{
+				{Key: "banned_array", Value: bson.D{{Key: "user_id", Value: bannedId}}},
+				{Key: "invited_array", Value: bson.D{{Key: "user_id", Value: bannedId}}},
+			}}},
+			options.FindOneAndUpdate().SetProjection(bson.D{
+				{Key: "banned_array", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "user_id", Value: bannedId}}}}},
+				{Key: "invited_array", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "user_id", Value: bannedId}}}}},
+			}),
+		).Decode(&old)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		restore := bson.D{}
+		if len(old.Banned_array) > 0 {
+			restore = append(restore, bson.E{Key: "banned_array", Value: bson.D{{Key: "$each", Value: old.Banned_array}}})
+		}
+		if len(old.Invited_array) > 0 {
+			restore = append(restore, bson.E{Key: "invited_array", Value: bson.D{{Key: "$each", Value: old.Invited_array}}})
+		}
+		if len(restore) > 0 {
+			undo.push(func(ctx context.Context) error {
+				_, err := d.collectionChats.UpdateOne(
+					ctx,
+					bson.D{{Key: "_id", Value: chatId}},
+					bson.D{{Key: "$push", Value: restore}},
+				)
+				return err
+			})
+		}
+
+		_, err = d.collectionChats.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: chatId}},
+			bson.D{{Key: "$push", Value: bson.D{{Key: "banned_array", Value: ban}}}},
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: chatId}},
+				bson.D{{Key: "$pull", Value: bson.D{{Key: "banned_array", Value: ban}}}},
+			)
+			return err
+		})
+
+		_, err = d.removeMemberSteps(ctx, undo, bannedId, chatId)
+		return err
+	})
+}
+
+//Снимаем бан пользователя в чате
+func (d DatabaseInterface) UnbanUser(user_id string, chat_id string, banned_id string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	bannedId, err := primitive.ObjectIDFromHex(banned_id)
+	if err != nil {
+		return errors.New("invalid banned user's id")
+	}
+
+	if !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_BAN) {
+		return errors.New("not enough permissions to unban")
+	}
+
+	res, err := d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "banned_array", Value: bson.D{{Key: "user_id", Value: bannedId}}}}}},
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errors.New("user is not banned")
+	}
+
+	return nil
+}
+
+//Передаем владение чатом, если его владелец user_id уходит из чата
+//Новым владельцем становится первый администратор, иначе первый участник
+//Если других участников нет, чат помечается удаляемым, возвращает true
+func (d DatabaseInterface) passOwnership(ctx context.Context, undo *undoLog, chat *structures.Chat, user_id primitive.ObjectID) (bool, error) {
+	if chat.Owner_id != user_id {
+		return false, nil
+	}
+
+	owner := primitive.NilObjectID
+	candidates := append(chat.Admins_array, chat.Users_array...)
+	for i := 0; i < len(candidates); i++ {
+		if candidates[i] != user_id {
+			owner = candidates[i]
+			break
+		}
+	}
+
+	//Чат без участников удаляем, владелец остается прежним
+	if owner == primitive.NilObjectID {
+		_, err := d.collectionChats.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: chat.Id}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "deleting", Value: true}}}},
+		)
+		if err != nil {
+			return false, err
+		}
+		undo.push(func(ctx context.Context) error {
+			_, err := d.collectionChats.UpdateOne(
+				ctx,
+				bson.D{{Key: "_id", Value: chat.Id}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "deleting", Value: chat.Deleting}}}},
+			)
+			return err
+		})
+		return true, nil
+	}
+
+	_, err := d.collectionChats.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: chat.Id}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "owner_id", Value: owner}}},
+			{Key: "$addToSet", Value: bson.D{{Key: "admins_array", Value: owner}}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	//Возвращаем владение, только если его не передали снова
+	//Нового владельца убираем из администраторов, только если он не был им раньше
+	revert := bson.D{{Key: "$set", Value: bson.D{{Key: "owner_id", Value: user_id}}}}
+	wasAdmin := false
+	for i := 0; i < len(chat.Admins_array); i++ {
+		if chat.Admins_array[i] == owner {
+			wasAdmin = true
+		}
+	}
+	if !wasAdmin {
+		revert = append(revert, bson.E{Key: "$pull", Value: bson.D{{Key: "admins_array", Value: owner}}})
+	}
+	undo.push(func(ctx context.Context) error {
+		_, err := d.collectionChats.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: chat.Id}, {Key: "owner_id", Value: owner}},
+			revert,
+		)
+		return err
+	})
+	return false, nil
+}
+
+//Проверки для изменения прав: действует владелец, чат не персональный, цель - участник чата
+func (d DatabaseInterface) checkOwnerAction(user_id string, chat_id string, target_id string) (primitive.ObjectID, primitive.ObjectID, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return chatId, primitive.NilObjectID, errors.New("invalid chat_id")
+	}
+	targetId, err := primitive.ObjectIDFromHex(target_id)
+	if err != nil {
+		return chatId, targetId, errors.New("invalid user's id")
+	}
+
+	if !d.UserIsOwner(user_id, chat_id) {
+		return chatId, targetId, errors.New("only owner can change admins")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return chatId, targetId, errors.New("chat not found")
+	}
+	if settings.Personal {
+		return chatId, targetId, errors.New("can't change admins of personal chat")
+	}
+
+	if !d.UserInChat(target_id, chat_id) {
+		return chatId, targetId, errors.New("user not in chat")
+	}
+
+	return chatId, targetId, nil
+}
+
+//Назначаем участника администратором
+//Назначенная участнику роль снимается, иначе она перекрыла бы права администратора
+func (d DatabaseInterface) PromoteAdmin(user_id string, chat_id string, target_id string) error {
+	chatId, targetId, err := d.checkOwnerAction(user_id, chat_id, target_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{
+			{Key: "$pull", Value: bson.D{{Key: "members_roles", Value: bson.D{{Key: "user_id", Value: targetId}}}}},
+			{Key: "$addToSet", Value: bson.D{{Key: "admins_array", Value: targetId}}},
+		},
+	)
+	return err
+}
+
+//Снимаем права администратора, владельца снять нельзя
+func (d DatabaseInterface) DemoteAdmin(user_id string, chat_id string, target_id string) error {
+	chatId, targetId, err := d.checkOwnerAction(user_id, chat_id, target_id)
+	if err != nil {
+		return err
+	}
+	if user_id == target_id {
+		return errors.New("owner can't be demoted")
+	}
+
+	//Снимаем и роль администратора, назначенную через members_roles
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$pull", Value: bson.D{
+			{Key: "admins_array", Value: targetId},
+			{Key: "members_roles", Value: bson.D{{Key: "user_id", Value: targetId}, {Key: "role", Value: ROLE_ADMIN}}},
+		}}},
+	)
+	return err
+}
+
+//Передаем владение чатом другому участнику
+//Прошлый владелец остается администратором
+func (d DatabaseInterface) TransferOwnership(user_id string, chat_id string, target_id string) error {
+	chatId, targetId, err := d.checkOwnerAction(user_id, chat_id, target_id)
+	if err != nil {
+		return err
+	}
+	if user_id == target_id {
+		return errors.New("user already owns chat")
+	}
+
+	ownerId, _ := primitive.ObjectIDFromHex(user_id)
+	res, err := d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}, {Key: "owner_id", Value: ownerId}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "owner_id", Value: targetId}}},
+			{Key: "$addToSet", Value: bson.D{{Key: "admins_array", Value: targetId}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errors.New("ownership changed concurrently")
+	}
+
+	return nil
+}
+
+//Удаляем аккаунт пользователя
+//Пользователь выходит из всех чатов, владение его чатами передается другим участникам
+func (d DatabaseInterface) DeleteAccount(user_id string) error {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return errors.New("invalid user's id")
+	}
+
+	chats, err := d.GetUsersChatsId(user_id)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(chats); i++ {
+		err = d.removeMember(userId, chats[i].Chat_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = d.collectionUserSettings.DeleteMany(context.TODO(), bson.D{{Key: "user_id", Value: user_id}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = d.collectionUsers.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: userId}})
+	return err
+}
+
+//Добавляем в чат системное сообщение о пользователе
+//Текст системного сообщения не шифруется
+func (d DatabaseInterface) insertSystemMessage(chat_id primitive.ObjectID, user_id primitive.ObjectID, system string, text string) error {
+	var msg structures.Message_noid
+	msg.Chat_id = chat_id
+	msg.User_id = user_id
+	msg.Text = []byte(text)
+	msg.Gtm_date = time.Now().UTC().Truncate(time.Millisecond)
+	msg.System = system
+
+	_, _, err := d.insertWithSeq(msg)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+//Выход пользователя из чата
+//Из персонального чата выйти нельзя, его можно только удалить
+func (d DatabaseInterface) LeaveChat(user_id string, chat_id string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	userId, _ := primitive.ObjectIDFromHex(user_id)
+
+	if !d.UserInChat(user_id, chat_id) {
+		return errors.New("user not in chat")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return errors.New("chat not found")
+	}
+	if settings.Personal {
+		return errors.New("can't leave personal chat, delete conversation instead")
+	}
+
+	err = d.removeMember(userId, chatId)
+	if err != nil {
+		return err
+	}
+
+	//Участник уже удален, поэтому ошибка системного сообщения только логируется
+	d.insertSystemMessage(chatId, userId, structures.SYSTEM_USER_LEFT, "")
+	return nil
+}
+
+//Удаление участника из чата
+//Права те же, что и для бана: владельца удалить нельзя, администратора - только владелец
+func (d DatabaseInterface) RemoveMember(user_id string, chat_id string, removed_id string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	removedId, err := primitive.ObjectIDFromHex(removed_id)
+	if err != nil || removed_id == user_id {
+		return errors.New("invalid removed user's id")
+	}
+
+	if !d.UserHasPermission(user_id, chat_id, structures.PERMISSION_BAN) {
+		return errors.New("not enough permissions to remove members")
+	}
+	if !d.UserInChat(removed_id, chat_id) {
+		return errors.New("user not in chat")
+	}
+	if d.UserIsOwner(removed_id, chat_id) {
+		return errors.New("can't remove owner")
+	}
+	if d.UserIsAdmin(removed_id, chat_id) && !d.UserIsOwner(user_id, chat_id) {
+		return errors.New("only owner can remove admin")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return errors.New("chat not found")
+	}
+	if settings.Personal {
+		return errors.New("can't remove members from personal chat")
+	}
+
+	err = d.removeMember(removedId, chatId)
+	if err != nil {
+		return err
+	}
+
+	//Как и при выходе, ошибка системного сообщения не отменяет удаление
+	d.insertSystemMessage(chatId, removedId, structures.SYSTEM_USER_REMOVED, "")
+	return nil
+}
+
+//Удаление персонального чата у обоих собеседников
+//Возвращает id участников, которых нужно уведомить
+func (d DatabaseInterface) DeleteConversation(user_id string, chat_id string) ([]string, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return nil, errors.New("invalid chat_id")
+	}
+
+	if !d.UserInChat(user_id, chat_id) {
+		return nil, errors.New("user not in chat")
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		return nil, errors.New("chat not found")
+	}
+	if !settings.Personal {
+		return nil, errors.New("only personal chats can be deleted as conversation")
+	}
+
+	chat, err := d.getChatDocument(chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	for i := 0; i < len(chat.Users_array); i++ {
+		members = append(members, chat.Users_array[i].Hex())
+	}
+
+	return members, d.deleteChatData(&chat)
+}
@@ -0,0 +1,223 @@
+package databaseInterface
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Запускаем все миграции по порядку
+//Миграции можно запускать повторно, уже обработанные документы пропускаются
+func (d DatabaseInterface) Migrate() error {
+	migrations := []struct {
+		name string
+		run  func() error
+	}{
+		{"messages dates", func() error { return d.migrateDates(&d.collectionMessages) }},
+		{"files dates", func() error { return d.migrateDates(&d.collectionFiles) }},
+		{"messages seq", d.migrateMessagesSeq},
+		{"messages search text", d.migrateSearchText},
+		{"chats owner", d.migrateChatsOwner},
+	}
+
+	for i := 0; i < len(migrations); i++ {
+		log.Print("Migration: ", migrations[i].name, "\n")
+		err := migrations[i].run()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Переводим строковые даты gtm_date и expiredat в BSON даты
+func (d DatabaseInterface) migrateDates(collection *mongo.Collection) error {
+	fields := []string{"gtm_date", "expiredat"}
+
+	var or bson.A
+	for i := 0; i < len(fields); i++ {
+		or = append(or, bson.D{{Key: fields[i], Value: bson.D{{Key: "$type", Value: "string"}}}})
+	}
+
+	cur, err := collection.Find(context.TODO(), bson.D{{Key: "$or", Value: or}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	counter := 0
+	for cur.Next(context.TODO()) {
+		var elem bson.M
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+
+		set := bson.D{}
+		unset := bson.D{}
+		for i := 0; i < len(fields); i++ {
+			value, ok := elem[fields[i]].(string)
+			if !ok {
+				continue
+			}
+			if value == "" {
+				unset = append(unset, bson.E{Key: fields[i], Value: ""})
+				continue
+			}
+			//Старые даты записывались в UTC
+			tm, err := time.Parse(structures.LEGACY_DATE_FORMAT, value)
+			if err != nil {
+				log.Println("Invalid date ", value, " in ", elem["_id"])
+				continue
+			}
+			set = append(set, bson.E{Key: fields[i], Value: tm})
+		}
+
+		update := bson.D{}
+		if len(set) > 0 {
+			update = append(update, bson.E{Key: "$set", Value: set})
+		}
+		if len(unset) > 0 {
+			update = append(update, bson.E{Key: "$unset", Value: unset})
+		}
+		if len(update) == 0 {
+			continue
+		}
+
+		_, err = collection.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: elem["_id"]}}, update)
+		if err != nil {
+			return err
+		}
+		counter++
+	}
+
+	log.Print(counter, " document(-s) converted in ", collection.Name(), "\n")
+	return cur.Err()
+}
+
+//Присваиваем номера сообщениям, созданным до появления seq
+//Сообщения нумеруются по дате отправки после уже выданных номеров чата
+func (d DatabaseInterface) migrateMessagesSeq() error {
+	noSeq := bson.D{{Key: "seq", Value: bson.D{{Key: "$exists", Value: false}}}}
+
+	chats, err := d.collectionMessages.Distinct(context.TODO(), "chat_id", noSeq)
+	if err != nil {
+		return err
+	}
+
+	counter := 0
+	for i := 0; i < len(chats); i++ {
+		chatId, ok := chats[i].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+
+		cur, err := d.collectionMessages.Find(
+			context.TODO(),
+			append(bson.D{{Key: "chat_id", Value: chatId}}, noSeq...),
+			options.Find().
+				SetSort(bson.D{{Key: "gtm_date", Value: 1}, {Key: "_id", Value: 1}}).
+				SetProjection(bson.D{{Key: "_id", Value: 1}}),
+		)
+		if err != nil {
+			return err
+		}
+
+		for cur.Next(context.TODO()) {
+			var elem structures.ID
+			err := cur.Decode(&elem)
+			if err != nil {
+				return err
+			}
+
+			seq, err := d.nextMessageSeq(chatId)
+			if err != nil {
+				return err
+			}
+
+			_, err = d.collectionMessages.UpdateOne(
+				context.TODO(),
+				bson.D{{Key: "_id", Value: elem.Id}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "seq", Value: seq}}}},
+			)
+			if err != nil {
+				return err
+			}
+			counter++
+		}
+		cur.Close(context.TODO())
+	}
+
+	log.Print(counter, " message(-s) numbered\n")
+	return nil
+}
+
+//Заполняем текст для поиска у сообщений незащищенных чатов
+func (d DatabaseInterface) migrateSearchText() error {
+	chats, err := d.collectionChatSettings.Distinct(context.TODO(), "chat_id", bson.D{{Key: "secured", Value: false}})
+	if err != nil {
+		return err
+	}
+
+	cur, err := d.collectionMessages.Find(context.TODO(), bson.D{
+		{Key: "chat_id", Value: bson.D{{Key: "$in", Value: chats}}},
+		{Key: "search_text", Value: bson.D{{Key: "$exists", Value: false}}},
+	}, options.Find().SetProjection(bson.D{{Key: "text", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	counter := 0
+	for cur.Next(context.TODO()) {
+		var elem structures.Message
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+		if len(elem.Text) == 0 {
+			continue
+		}
+
+		_, err = d.collectionMessages.UpdateOne(
+			context.TODO(),
+			bson.D{{Key: "_id", Value: elem.Id}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "search_text", Value: string(elem.Text)}}}},
+		)
+		if err != nil {
+			return err
+		}
+		counter++
+	}
+
+	log.Print(counter, " message(-s) indexed for search\n")
+	return cur.Err()
+}
+
+//Назначаем владельцем чата первого администратора
+func (d DatabaseInterface) migrateChatsOwner() error {
+	res, err := d.collectionChats.UpdateMany(
+		context.TODO(),
+		bson.D{{Key: "owner_id", Value: bson.D{{Key: "$exists", Value: false}}}},
+		mongo.Pipeline{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "owner_id", Value: bson.D{
+				{Key: "$arrayElemAt", Value: bson.A{"$admins_array", 0}},
+			}}}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Print(res.ModifiedCount, " chat owner(-s) assigned\n")
+	return nil
+}
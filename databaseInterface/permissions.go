@@ -0,0 +1,320 @@
+package databaseInterface
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Встроенные роли чата
+const ROLE_OWNER = "owner"
+const ROLE_ADMIN = "admin"
+const ROLE_MEMBER = "member"
+const ROLE_READER = "reader"
+const ROLE_SUBSCRIBER = "subscriber"
+
+//Ошибка отправки сообщения без права на запись
+var ErrNoWritePermission = errors.New("NO_WRITE_PERMISSION")
+
+//Права встроенных ролей, чат может переопределить их, кроме владельца
+var DEFAULT_ROLES = []structures.Role{
+	{Name: ROLE_ADMIN, Permissions: structures.PERMISSION_ALL},
+	{Name: ROLE_MEMBER, Permissions: structures.PERMISSION_SEND_MESSAGES | structures.PERMISSION_SEND_MEDIA | structures.PERMISSION_COMMENT},
+	{Name: ROLE_SUBSCRIBER, Permissions: structures.PERMISSION_COMMENT},
+	{Name: ROLE_READER, Permissions: 0},
+}
+
+//Роль участника по умолчанию берется из Users_write_permission
+//В каналах участники по умолчанию подписчики
+func defaultMemberRole(settings *structures.Chat_settings) string {
+	if settings.Channel {
+		return ROLE_SUBSCRIBER
+	}
+	if settings.Users_write_permission {
+		return ROLE_MEMBER
+	}
+	return ROLE_READER
+}
+
+//Получаем права роли чата
+func rolePermissions(chat *structures.Chat, role string) (structures.Permission, bool) {
+	if role == ROLE_OWNER {
+		return structures.PERMISSION_ALL, true
+	}
+	for i := 0; i < len(chat.Roles); i++ {
+		if chat.Roles[i].Name == role {
+			return chat.Roles[i].Permissions, true
+		}
+	}
+	for i := 0; i < len(DEFAULT_ROLES); i++ {
+		if DEFAULT_ROLES[i].Name == role {
+			return DEFAULT_ROLES[i].Permissions, true
+		}
+	}
+	return 0, false
+}
+
+//Проверяем, что бан пользователя действует на момент now
+func banActive(ban *structures.Ban, now time.Time) bool {
+	return ban.ExpiredAt == nil || ban.ExpiredAt.Time().After(now)
+}
+
+//Получаем роль участника чата, пустая строка - не участник
+func memberRole(chat *structures.Chat, settings *structures.Chat_settings, user_id primitive.ObjectID, now time.Time) string {
+	member := false
+	for i := 0; i < len(chat.Users_array); i++ {
+		if chat.Users_array[i] == user_id {
+			member = true
+		}
+	}
+	for i := 0; i < len(chat.Banned_array); i++ {
+		if chat.Banned_array[i].User_id == user_id && banActive(&chat.Banned_array[i], now) {
+			member = false
+		}
+	}
+	if !member {
+		return ""
+	}
+
+	if chat.Owner_id == user_id {
+		return ROLE_OWNER
+	}
+	for i := 0; i < len(chat.Members_roles); i++ {
+		if chat.Members_roles[i].User_id == user_id {
+			return chat.Members_roles[i].Role
+		}
+	}
+	for i := 0; i < len(chat.Admins_array); i++ {
+		if chat.Admins_array[i] == user_id {
+			return ROLE_ADMIN
+		}
+	}
+
+	return defaultMemberRole(settings)
+}
+
+//Проверяем есть ли у пользователя право в чате
+//Не участники и забаненные не имеют прав, владелец имеет все права
+func chatPermits(chat *structures.Chat, settings *structures.Chat_settings, user_id primitive.ObjectID, permission structures.Permission, now time.Time) bool {
+	//Удаляемый чат доступен только для чтения
+	if chat.Deleting {
+		return false
+	}
+	role := memberRole(chat, settings, user_id, now)
+	if role == "" {
+		return false
+	}
+
+	permissions, ok := rolePermissions(chat, role)
+	if !ok {
+		//Роль удалена, действуют права по умолчанию
+		permissions, _ = rolePermissions(chat, defaultMemberRole(settings))
+	}
+
+	return permissions&permission == permission
+}
+
+//Получаем чат и его настройки для проверки прав
+func (d DatabaseInterface) getChatWithOptions(chat_id string) (*structures.Chat, *structures.Chat_settings, error) {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return nil, nil, errors.New("invalid chat_id")
+	}
+
+	chat, err := d.getChatDocument(chatId)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	settings, err := d.getChatsOptions(chat_id)
+	if err != nil || settings == nil {
+		log.Println(err)
+		return nil, nil, errors.New("chat not found")
+	}
+
+	return &chat, settings, nil
+}
+
+//Единая проверка прав пользователя в чате
+func (d DatabaseInterface) UserHasPermission(user_id string, chat_id string, permission structures.Permission) bool {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return false
+	}
+
+	chat, settings, err := d.getChatWithOptions(chat_id)
+	if err != nil {
+		return false
+	}
+
+	return chatPermits(chat, settings, userId, permission, time.Now().UTC())
+}
+
+//Получаем роль пользователя в чате, пустая строка - не участник
+func (d DatabaseInterface) UserRole(user_id string, chat_id string) string {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return ""
+	}
+
+	chat, settings, err := d.getChatWithOptions(chat_id)
+	if err != nil {
+		return ""
+	}
+
+	return memberRole(chat, settings, userId, time.Now().UTC())
+}
+
+//Переводим названия прав в маску
+func ParsePermissions(names []string) (structures.Permission, error) {
+	var res structures.Permission
+	for i := 0; i < len(names); i++ {
+		permission, ok := structures.PERMISSION_NAMES[names[i]]
+		if !ok {
+			return 0, errors.New("unknown permission " + names[i])
+		}
+		res |= permission
+	}
+	return res, nil
+}
+
+//Создаем или изменяем роль чата, доступно только владельцу
+func (d DatabaseInterface) SetChatRole(user_id string, chat_id string, name string, permissions structures.Permission) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	if name == "" || name == ROLE_OWNER {
+		return errors.New("invalid role name")
+	}
+	if !d.UserIsOwner(user_id, chat_id) {
+		return errors.New("only owner can change roles")
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "roles", Value: bson.D{{Key: "name", Value: name}}}}}},
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "roles", Value: structures.Role{Name: name, Permissions: permissions}}}}},
+	)
+	return err
+}
+
+//Удаляем роль чата, участники с этой ролью получают роль по умолчанию
+//Для встроенных ролей восстанавливаются права по умолчанию
+func (d DatabaseInterface) DeleteChatRole(user_id string, chat_id string, name string) error {
+	chatId, err := primitive.ObjectIDFromHex(chat_id)
+	if err != nil {
+		return errors.New("invalid chat_id")
+	}
+	if !d.UserIsOwner(user_id, chat_id) {
+		return errors.New("only owner can change roles")
+	}
+
+	update := bson.D{{Key: "roles", Value: bson.D{{Key: "name", Value: name}}}}
+	builtin := false
+	for i := 0; i < len(DEFAULT_ROLES); i++ {
+		if DEFAULT_ROLES[i].Name == name {
+			builtin = true
+		}
+	}
+	if !builtin {
+		update = append(update, bson.E{Key: "members_roles", Value: bson.D{{Key: "role", Value: name}}})
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$pull", Value: update}},
+	)
+	return err
+}
+
+//Назначаем роль участнику чата, пустая роль возвращает роль по умолчанию
+func (d DatabaseInterface) SetMemberRole(user_id string, chat_id string, target_id string, role string) error {
+	chatId, targetId, err := d.checkOwnerAction(user_id, chat_id, target_id)
+	if err != nil {
+		return err
+	}
+	if user_id == target_id || role == ROLE_OWNER {
+		return errors.New("owner role can only be transferred")
+	}
+
+	if role != "" {
+		chat, err := d.getChatDocument(chatId)
+		if err != nil {
+			return err
+		}
+		if _, ok := rolePermissions(&chat, role); !ok {
+			return errors.New("unknown role")
+		}
+	}
+
+	//admins_array отражает роль администратора, чтобы не расходиться с members_roles
+	update := bson.D{{Key: "$pull", Value: bson.D{
+		{Key: "members_roles", Value: bson.D{{Key: "user_id", Value: targetId}}},
+		{Key: "admins_array", Value: targetId},
+	}}}
+	if role == ROLE_ADMIN {
+		update = bson.D{
+			{Key: "$pull", Value: bson.D{{Key: "members_roles", Value: bson.D{{Key: "user_id", Value: targetId}}}}},
+			{Key: "$addToSet", Value: bson.D{{Key: "admins_array", Value: targetId}}},
+		}
+	}
+	_, err = d.collectionChats.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: chatId}}, update)
+	if err != nil || role == "" {
+		return err
+	}
+
+	_, err = d.collectionChats.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: chatId}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "members_roles", Value: structures.Member_role{User_id: targetId, Role: role}}}}},
+	)
+	return err
+}
+
+//Проверяем право на отправку сообщения
+//Ответ на сообщение чата (комментарий) разрешен и с правом комментирования
+func (d DatabaseInterface) checkSendPermission(user_id string, chat_id primitive.ObjectID, replied_id string) (primitive.ObjectID, error) {
+	if replied_id == "" {
+		if !d.UserHasPermission(user_id, chat_id.Hex(), structures.PERMISSION_SEND_MESSAGES) {
+			return primitive.NilObjectID, ErrNoWritePermission
+		}
+		return primitive.NilObjectID, nil
+	}
+
+	repliedId, err := primitive.ObjectIDFromHex(replied_id)
+	if err != nil {
+		return primitive.NilObjectID, errors.New("invalid replied_id")
+	}
+	count, err := d.collectionMessages.CountDocuments(context.TODO(), bson.D{
+		{Key: "_id", Value: repliedId},
+		{Key: "chat_id", Value: chat_id},
+	})
+	if err != nil || count == 0 {
+		return primitive.NilObjectID, errors.New("replied message not found")
+	}
+
+	if !d.UserHasPermission(user_id, chat_id.Hex(), structures.PERMISSION_SEND_MESSAGES) &&
+		!d.UserHasPermission(user_id, chat_id.Hex(), structures.PERMISSION_COMMENT) {
+		return primitive.NilObjectID, ErrNoWritePermission
+	}
+	return repliedId, nil
+}
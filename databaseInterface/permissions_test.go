@@ -0,0 +1,103 @@
+package databaseInterface
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+func TestChatPermits(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	past := structures.Date(now.Add(-time.Hour))
+	future := structures.Date(now.Add(time.Hour))
+
+	owner := primitive.NewObjectID()
+	admin := primitive.NewObjectID()
+	member := primitive.NewObjectID()
+	stranger := primitive.NewObjectID()
+
+	group := &structures.Chat_settings{Users_write_permission: true}
+	readOnly := &structures.Chat_settings{Users_write_permission: false}
+	channel := &structures.Chat_settings{Channel: true}
+
+	//Чат с владельцем, администратором и участником, изменения вносит каждый случай
+	newChat := func(change func(chat *structures.Chat)) *structures.Chat {
+		chat := &structures.Chat{
+			Owner_id:     owner,
+			Admins_array: []primitive.ObjectID{admin},
+			Users_array:  []primitive.ObjectID{owner, admin, member},
+		}
+		if change != nil {
+			change(chat)
+		}
+		return chat
+	}
+
+	tests := []struct {
+		name       string
+		chat       *structures.Chat
+		settings   *structures.Chat_settings
+		user       primitive.ObjectID
+		permission structures.Permission
+		want       bool
+	}{
+		{"owner has all permissions", newChat(nil), group, owner, structures.PERMISSION_ALL, true},
+		{"owner keeps permissions when roles are redefined", newChat(func(chat *structures.Chat) {
+			chat.Roles = []structures.Role{{Name: ROLE_OWNER, Permissions: 0}}
+		}), group, owner, structures.PERMISSION_BAN, true},
+		{"admin can ban", newChat(nil), group, admin, structures.PERMISSION_BAN, true},
+		{"admin can post in channel", newChat(nil), channel, admin, structures.PERMISSION_SEND_MESSAGES, true},
+		{"default member can send", newChat(nil), group, member, structures.PERMISSION_SEND_MESSAGES, true},
+		{"default member can't ban", newChat(nil), group, member, structures.PERMISSION_BAN, false},
+		{"default member is reader without write permission", newChat(nil), readOnly, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"subscriber can't post in channel", newChat(nil), channel, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"subscriber can comment in channel", newChat(nil), channel, member, structures.PERMISSION_COMMENT, true},
+		{"reader role can't send", newChat(func(chat *structures.Chat) {
+			chat.Members_roles = []structures.Member_role{{User_id: member, Role: ROLE_READER}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"members_roles overrides admins_array", newChat(func(chat *structures.Chat) {
+			chat.Members_roles = []structures.Member_role{{User_id: admin, Role: ROLE_MEMBER}}
+		}), group, admin, structures.PERMISSION_BAN, false},
+		{"custom role grants permission", newChat(func(chat *structures.Chat) {
+			chat.Roles = []structures.Role{{Name: "moderator", Permissions: structures.PERMISSION_BAN}}
+			chat.Members_roles = []structures.Member_role{{User_id: member, Role: "moderator"}}
+		}), group, member, structures.PERMISSION_BAN, true},
+		{"chat redefines builtin role", newChat(func(chat *structures.Chat) {
+			chat.Roles = []structures.Role{{Name: ROLE_MEMBER, Permissions: structures.PERMISSION_PIN}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"deleted role falls back to default", newChat(func(chat *structures.Chat) {
+			chat.Members_roles = []structures.Member_role{{User_id: member, Role: "deleted"}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, true},
+		{"deleted role doesn't keep its permissions", newChat(func(chat *structures.Chat) {
+			chat.Members_roles = []structures.Member_role{{User_id: member, Role: "deleted"}}
+		}), group, member, structures.PERMISSION_BAN, false},
+		{"active ban", newChat(func(chat *structures.Chat) {
+			chat.Banned_array = []structures.Ban{{User_id: member, ExpiredAt: &future}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"permanent ban", newChat(func(chat *structures.Chat) {
+			chat.Banned_array = []structures.Ban{{User_id: member}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, false},
+		{"expired ban", newChat(func(chat *structures.Chat) {
+			chat.Banned_array = []structures.Ban{{User_id: member, ExpiredAt: &past}}
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, true},
+		{"not a member", newChat(nil), group, stranger, structures.PERMISSION_SEND_MESSAGES, false},
+		{"deleting chat is read only for owner", newChat(func(chat *structures.Chat) {
+			chat.Deleting = true
+		}), group, owner, structures.PERMISSION_SEND_MESSAGES, false},
+		{"deleting chat is read only for member", newChat(func(chat *structures.Chat) {
+			chat.Deleting = true
+		}), group, member, structures.PERMISSION_SEND_MESSAGES, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chatPermits(tt.chat, tt.settings, tt.user, tt.permission, now)
+			if got != tt.want {
+				t.Errorf("chatPermits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
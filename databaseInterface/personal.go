@@ -0,0 +1,210 @@
+package databaseInterface
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"log"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	security "github.com/MUR4SH/MyMessenger/security"
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Ключ пары собеседников персонального чата, не зависит от порядка пользователей
+func personalPairKey(first_id primitive.ObjectID, second_id primitive.ObjectID) string {
+	ids := []string{first_id.Hex(), second_id.Hex()}
+	sort.Strings(ids)
+	return ids[0] + ":" + ids[1]
+}
+
+//Ищем персональный чат по ключу пары
+func (d DatabaseInterface) findPersonalChat(pair_key string) (string, bool) {
+	var res structures.ID
+	err := d.collectionChats.FindOne(
+		context.TODO(),
+		bson.D{{Key: "pair_key", Value: pair_key}},
+		options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}}),
+	).Decode(&res)
+	if err != nil {
+		return "", false
+	}
+	return res.Id.Hex(), true
+}
+
+//Объединяем дубликаты персональных чатов
+//В каждой паре остается самый старый чат, сообщения остальных переносятся в него
+//Сообщения защищенных чатов перешифровываются ключом оставшегося чата
+func (d DatabaseInterface) MergePersonalChats() error {
+	settings, err := d.collectionChatSettings.Distinct(context.TODO(), "chat_id", bson.D{{Key: "personal", Value: true}})
+	if err != nil {
+		return err
+	}
+
+	pairs := map[string][]structures.Chat{}
+	var keys []string
+	for i := 0; i < len(settings); i++ {
+		chatId, ok := settings[i].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		chat, err := d.getChatDocument(chatId)
+		if err != nil || chat.Deleting || len(chat.Users_array) != 2 {
+			continue
+		}
+
+		key := personalPairKey(chat.Users_array[0], chat.Users_array[1])
+		if _, ok := pairs[key]; !ok {
+			keys = append(keys, key)
+		}
+		pairs[key] = append(pairs[key], chat)
+	}
+
+	merged := 0
+	for _, key := range keys {
+		chats := pairs[key]
+		sort.Slice(chats, func(i, j int) bool {
+			return chats[i].Id.Timestamp().Before(chats[j].Id.Timestamp())
+		})
+
+		if len(chats) > 1 {
+			err = d.mergeChats(&chats[0], chats[1:])
+			if err != nil {
+				log.Println("Merging personal chats " + key + " failed")
+				return err
+			}
+			merged += len(chats) - 1
+		}
+
+		_, err = d.collectionChats.UpdateOne(
+			context.TODO(),
+			bson.D{{Key: "_id", Value: chats[0].Id}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "pair_key", Value: key}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Merged %d duplicate personal chats\n", merged)
+
+	//Уникальный индекс не создается, пока есть дубликаты
+	d.ensureIndexes()
+
+	return nil
+}
+
+//Переносим сообщения и файлы дубликатов в чат target и удаляем дубликаты
+//Номера сообщений пересчитываются по дате отправки
+func (d DatabaseInterface) mergeChats(target *structures.Chat, duplicates []structures.Chat) error {
+	targetKey, err := d.getChatPrivateKey(target.Id)
+	if err != nil {
+		return err
+	}
+
+	ids := []primitive.ObjectID{target.Id}
+	keys := map[primitive.ObjectID]*rsa.PrivateKey{}
+	for i := 0; i < len(duplicates); i++ {
+		ids = append(ids, duplicates[i].Id)
+		key, err := d.getChatPrivateKey(duplicates[i].Id)
+		if err != nil {
+			return err
+		}
+		keys[duplicates[i].Id] = key
+	}
+
+	cur, err := d.collectionMessages.Find(
+		context.TODO(),
+		bson.D{{Key: "chat_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+		options.Find().SetSort(bson.D{{Key: "gtm_date", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	//Сначала отрицательные номера, чтобы не нарушить уникальность (chat_id, seq)
+	var seq int64
+	for cur.Next(context.TODO()) {
+		var msg structures.Message_noid
+		err := cur.Decode(&msg)
+		if err != nil {
+			return err
+		}
+		id := cur.Current.Lookup("_id").ObjectID()
+		seq++
+
+		update := bson.D{
+			{Key: "chat_id", Value: target.Id},
+			{Key: "seq", Value: -seq},
+		}
+		key, ok := keys[msg.Chat_id]
+		if ok && msg.System == "" && len(msg.Text) > 0 {
+			text := security.Decrypt(msg.Text, key)
+			if text == nil {
+				return errors.New("can't decrypt message " + id.Hex())
+			}
+			update = append(update, bson.E{Key: "text", Value: security.Encrypt(string(text), &targetKey.PublicKey)})
+		}
+
+		_, err = d.collectionMessages.UpdateOne(
+			context.TODO(),
+			bson.D{{Key: "_id", Value: id}},
+			bson.D{{Key: "$set", Value: update}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	_, err = d.collectionMessages.UpdateMany(
+		context.TODO(),
+		bson.D{{Key: "chat_id", Value: target.Id}, {Key: "seq", Value: bson.D{{Key: "$lt", Value: 0}}}},
+		bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "seq", Value: bson.D{{Key: "$multiply", Value: bson.A{"$seq", -1}}}}}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	var files []primitive.ObjectID
+	for i := 0; i < len(duplicates); i++ {
+		files = append(files, duplicates[i].Files_array...)
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "messages_seq", Value: seq}}}}
+	if len(files) > 0 {
+		update = append(update, bson.E{Key: "$addToSet", Value: bson.D{{Key: "files_array", Value: bson.D{{Key: "$each", Value: files}}}}})
+	}
+	_, err = d.collectionChats.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: target.Id}}, update)
+	if err != nil {
+		return err
+	}
+
+	//Старые номера прочтения больше не действительны, считаем историю прочитанной
+	_, err = d.collectionChatsArray.UpdateMany(
+		context.TODO(),
+		bson.D{{Key: "chat_id", Value: target.Id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_read_seq", Value: seq}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(duplicates); i++ {
+		//Файлы и сообщения уже перенесены, удаляются только записи дубликата
+		duplicate := duplicates[i]
+		duplicate.Files_array = nil
+		duplicate.Chat_logo = primitive.NilObjectID
+		err = d.deleteChatData(&duplicate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package databaseInterface
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Запоминаем время, когда пользователь последний раз был в сети
+func (d DatabaseInterface) SetLastSeen(user_id string, date time.Time) error {
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return errors.New("invalid user_id")
+	}
+
+	_, err = d.collectionUsers.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: userId}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_seen", Value: structures.Date(date.UTC().Truncate(time.Millisecond))}}}},
+	)
+	return err
+}
+
+//Меняем, кому видно время последнего входа и статус в сети
+func (d DatabaseInterface) SetLastSeenVisibility(user_id string, visibility string) error {
+	switch visibility {
+	case structures.LAST_SEEN_EVERYONE, structures.LAST_SEEN_CONTACTS, structures.LAST_SEEN_NOBODY:
+	default:
+		return errors.New("invalid visibility")
+	}
+
+	_, err := d.collectionUserSettings.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "user_id", Value: user_id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_seen_visibility", Value: visibility}}}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+//Получаем настройку видимости, без настроек время видно всем
+func (d DatabaseInterface) lastSeenVisibility(user_id string) string {
+	var res structures.Personal_settings
+	err := d.collectionUserSettings.FindOne(context.TODO(), bson.D{{Key: "user_id", Value: user_id}}).Decode(&res)
+	if err != nil {
+		return structures.LAST_SEEN_EVERYONE
+	}
+	return res.Last_seen_visibility
+}
+
+//Может ли viewer_id видеть время последнего входа owner_id
+//Контакты - пользователи, с которыми есть персональный чат
+func (d DatabaseInterface) lastSeenAllowed(visibility string, owner_id string, viewer_id string) bool {
+	if owner_id == viewer_id {
+		return true
+	}
+	switch visibility {
+	case structures.LAST_SEEN_NOBODY:
+		return false
+	case structures.LAST_SEEN_CONTACTS:
+		ok, _ := d.hasPersonalChat(owner_id, viewer_id)
+		return ok
+	default:
+		return true
+	}
+}
+
+func (d DatabaseInterface) LastSeenVisible(owner_id string, viewer_id string) bool {
+	return d.lastSeenAllowed(d.lastSeenVisibility(owner_id), owner_id, viewer_id)
+}
+
+//Получаем собеседников пользователя по персональным чатам
+func (d DatabaseInterface) personalContacts(user_id string) map[string]bool {
+	res := make(map[string]bool)
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return res
+	}
+
+	cur, err := d.collectionChats.Aggregate(context.TODO(), mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "users_array", Value: userId}}}},
+		bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Chat_settings"},
+			{Key: "localField", Value: "options"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "options"},
+			{Key: "pipeline", Value: []bson.D{{{
+				Key: "$match", Value: bson.D{
+					{Key: "personal", Value: true},
+				}}},
+			}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "options.0", Value: bson.D{{
+			Key: "$exists", Value: true,
+		}}}}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "users_array", Value: 1}}}},
+	})
+	if err != nil {
+		log.Println(err)
+		return res
+	}
+
+	var chats []structures.Chat
+	err = cur.All(context.TODO(), &chats)
+	if err != nil {
+		log.Println(err)
+		return res
+	}
+
+	for i := 0; i < len(chats); i++ {
+		for j := 0; j < len(chats[i].Users_array); j++ {
+			if chats[i].Users_array[j] != userId {
+				res[chats[i].Users_array[j].Hex()] = true
+			}
+		}
+	}
+	return res
+}
+
+//Оставляем из viewers тех, кому видно присутствие owner_id
+//Контакты владельца получаем один раз на весь список
+func (d DatabaseInterface) LastSeenViewers(owner_id string, viewers []string) []string {
+	visibility := d.lastSeenVisibility(owner_id)
+	if visibility == structures.LAST_SEEN_NOBODY {
+		return nil
+	}
+
+	var contacts map[string]bool
+	if visibility == structures.LAST_SEEN_CONTACTS {
+		contacts = d.personalContacts(owner_id)
+	}
+
+	var res []string
+	for i := 0; i < len(viewers); i++ {
+		if viewers[i] == owner_id || contacts == nil || contacts[viewers[i]] {
+			res = append(res, viewers[i])
+		}
+	}
+	return res
+}
@@ -0,0 +1,437 @@
+package databaseInterface
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Количество символов вокруг найденного слова в сниппете
+const SNIPPET_RADIUS = 60
+
+//Получаем незащищенные чаты пользователя, в которых можно искать
+func (d DatabaseInterface) searchableChats(user_id string) ([]primitive.ObjectID, error) {
+	var res []primitive.ObjectID
+
+	chats, err := d.GetUsersChatsId(user_id)
+	if err != nil {
+		return nil, err
+	}
+	if len(chats) == 0 {
+		return res, nil
+	}
+
+	var ids []primitive.ObjectID
+	for i := 0; i < len(chats); i++ {
+		ids = append(ids, chats[i].Chat_id)
+	}
+
+	cur, err := d.collectionChatSettings.Find(context.TODO(), bson.D{
+		{Key: "chat_id", Value: bson.D{{Key: "$in", Value: ids}}},
+		{Key: "secured", Value: false},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(context.TODO()) {
+		var elem structures.Chat_settings
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		res = append(res, elem.Chat_id)
+	}
+
+	return res, nil
+}
+
+//Поиск сообщений по тексту в незащищенных чатах пользователя
+//cursor - id последнего сообщения предыдущей страницы
+func (d DatabaseInterface) SearchMessages(
+	user_id string,
+	query string,
+	filter structures.MessageSearchFilter,
+	limit int,
+	cursor string,
+) (structures.MessageSearchPage, error) {
+	var page structures.MessageSearchPage
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return page, errors.New("empty query")
+	}
+
+	if limit <= 0 || limit > LIMIT_MAX {
+		limit = LIMIT
+	}
+
+	chats, err := d.searchableChats(user_id)
+	if err != nil {
+		return page, err
+	}
+
+	//Защищенные чаты хранят шифротекст, по ним не ищем
+	if filter.Chat_id != "" {
+		chatId, err := primitive.ObjectIDFromHex(filter.Chat_id)
+		if err != nil {
+			return page, errors.New("invalid chat_id")
+		}
+		found := false
+		for i := 0; i < len(chats); i++ {
+			if chats[i] == chatId {
+				found = true
+			}
+		}
+		if !found {
+			return page, errors.New("chat is not available for search")
+		}
+		chats = []primitive.ObjectID{chatId}
+	}
+
+	if len(chats) == 0 {
+		return page, nil
+	}
+
+	match := bson.D{
+		{Key: "$text", Value: bson.D{{Key: "$search", Value: query}}},
+		{Key: "chat_id", Value: bson.D{{Key: "$in", Value: chats}}},
+	}
+
+	if filter.User_id != "" {
+		userId, err := primitive.ObjectIDFromHex(filter.User_id)
+		if err != nil {
+			return page, errors.New("invalid user_id")
+		}
+		match = append(match, bson.E{Key: "user_id", Value: userId})
+	}
+
+	date := bson.D{}
+	if !filter.From.IsZero() {
+		date = append(date, bson.E{Key: "$gte", Value: filter.From})
+	}
+	if !filter.To.IsZero() {
+		date = append(date, bson.E{Key: "$lte", Value: filter.To})
+	}
+	if len(date) > 0 {
+		match = append(match, bson.E{Key: "gtm_date", Value: date})
+	}
+
+	if filter.Has_attachments != nil {
+		match = append(match, bson.E{Key: "files_array.0", Value: bson.D{{Key: "$exists", Value: *filter.Has_attachments}}})
+	}
+
+	if cursor != "" {
+		cursorId, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return page, errors.New("invalid cursor")
+		}
+		match = append(match, bson.E{Key: "_id", Value: bson.D{{Key: "$lt", Value: cursorId}}})
+	}
+
+	cur, err := d.collectionMessages.Aggregate(context.TODO(), mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: limit + 1}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "expiredat", Value: 0},
+		}}},
+		messageUserLookup(),
+	})
+	if err != nil {
+		log.Println(err)
+		return page, err
+	}
+
+	terms := searchTerms(query)
+	for cur.Next(context.TODO()) {
+		var elem structures.MessageToUser
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			return page, err
+		}
+
+		page.Results = append(page.Results, structures.MessageSearchResult{
+			Message: elem,
+			Snippet: highlightSnippet(string(elem.Text), terms),
+		})
+	}
+
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		page.Next_cursor = page.Results[limit-1].Message.Id.Hex()
+	}
+
+	return page, nil
+}
+
+//Слова запроса для подсветки, без кавычек фраз и исключенных слов
+func searchTerms(query string) []string {
+	var res []string
+	//Регистр меняется так же, как в highlightSnippet
+	words := strings.Fields(strings.Map(unicode.ToLower, strings.ReplaceAll(query, "\"", " ")))
+	for i := 0; i < len(words); i++ {
+		if !strings.HasPrefix(words[i], "-") {
+			res = append(res, words[i])
+		}
+	}
+	return res
+}
+
+//Вырезаем кусок текста вокруг первого найденного слова
+//Текст экранируется, найденные слова оборачиваются в <mark>
+func highlightSnippet(text string, terms []string) string {
+	runes := []rune(text)
+	//Меняем регистр посимвольно, чтобы индексы совпадали с исходным текстом
+	//strings.ToLower может изменить число символов
+	lower := make([]rune, len(runes))
+	for i := 0; i < len(runes); i++ {
+		lower[i] = unicode.ToLower(runes[i])
+	}
+
+	//Ищем первое вхождение любого из слов
+	first := -1
+	for i := 0; i < len(terms); i++ {
+		idx := strings.Index(string(lower), terms[i])
+		if idx < 0 {
+			continue
+		}
+		pos := utf8.RuneCountInString(string(lower)[:idx])
+		if first < 0 || pos < first {
+			first = pos
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+
+	start := first - SNIPPET_RADIUS
+	if start < 0 {
+		start = 0
+	}
+	end := first + SNIPPET_RADIUS
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+
+	//Размечаем найденные слова в пределах сниппета
+	for i := start; i < end; {
+		matched := 0
+		for j := 0; j < len(terms); j++ {
+			term := []rune(terms[j])
+			if i+len(term) <= len(lower) && string(lower[i:i+len(term)]) == terms[j] && len(term) > matched {
+				matched = len(term)
+			}
+		}
+		if matched > 0 {
+			b.WriteString("<mark>")
+			b.WriteString(html.EscapeString(string(runes[i : i+matched])))
+			b.WriteString("</mark>")
+			i += matched
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		i++
+	}
+
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
+
+//Поиск открытых чатов в каталоге
+//mode "prefix" - по началу названия, "text" - по словам названия и описания
+func (d DatabaseInterface) SearchChats(query string, mode string, limit int, offset int) ([]structures.Chat_public, error) {
+	var res []structures.Chat_public
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+
+	if limit <= 0 || limit > LIMIT_MAX {
+		limit = LIMIT
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	var match bson.D
+	var sort bson.D
+	project := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "chat_name", Value: 1},
+		{Key: "chat_logo", Value: 1},
+		{Key: "description", Value: 1},
+		{Key: "members_count", Value: bson.D{
+			{Key: "$size", Value: "$users_array"},
+		}},
+	}
+	switch mode {
+	case "text":
+		match = bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: query}}}}
+		sort = bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}}, {Key: "_id", Value: 1}}
+		//Релевантность доступна только при текстовом поиске
+		project = append(project, bson.E{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}})
+	case "prefix", "":
+		match = bson.D{{Key: "chat_name", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query), Options: "i"}}}
+		sort = bson.D{{Key: "members_count", Value: -1}, {Key: "_id", Value: 1}}
+	default:
+		return nil, errors.New("unknown search mode")
+	}
+
+	//Удаляемые чаты в каталог не попадают
+	match = append(match, bson.E{Key: "deleting", Value: bson.D{{Key: "$ne", Value: true}}})
+
+	cur, err := d.collectionChats.Aggregate(context.TODO(), mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Chat_settings"},
+			{Key: "localField", Value: "options"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "options"},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "options.search_visible", Value: true},
+			{Key: "options.personal", Value: false},
+		}}},
+		bson.D{{Key: "$project", Value: project}},
+		bson.D{{Key: "$sort", Value: sort}},
+		bson.D{{Key: "$skip", Value: offset}},
+		bson.D{{Key: "$limit", Value: limit}},
+		bson.D{{
+			Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: "Files"},
+				{Key: "localField", Value: "chat_logo"},
+				{Key: "foreignField", Value: "_id"},
+				{Key: "as", Value: "chat_logo"},
+				{Key: "pipeline", Value: []bson.D{
+					{{
+						Key: "$project", Value: bson.D{
+							{Key: "url", Value: 1},
+						},
+					}},
+				}},
+			},
+		}},
+	})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	for cur.Next(context.TODO()) {
+		var elem structures.Chat_public
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		res = append(res, elem)
+	}
+
+	return res, nil
+}
+
+//Поиск пользователей по логину
+//mode "prefix" - по началу логина, "fuzzy" - буквы запроса идут в логине по порядку, но не подряд
+//Пользователи, заблокированные ищущим или заблокировавшие его, не возвращаются
+func (d DatabaseInterface) SearchUsers(user_id string, query string, mode string, limit int, offset int) ([]structures.User_lite, error) {
+	var res []structures.User_lite
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+
+	userId, err := primitive.ObjectIDFromHex(user_id)
+	if err != nil {
+		return nil, errors.New("invalid user's id")
+	}
+
+	if limit <= 0 || limit > LIMIT_MAX {
+		limit = LIMIT
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	var pattern string
+	switch mode {
+	case "prefix", "":
+		pattern = "^" + regexp.QuoteMeta(query)
+	case "fuzzy":
+		letters := []rune(query)
+		for i := 0; i < len(letters); i++ {
+			if i > 0 {
+				pattern += ".*"
+			}
+			pattern += regexp.QuoteMeta(string(letters[i]))
+		}
+	default:
+		return nil, errors.New("unknown search mode")
+	}
+
+	blocked := d.getBlocked(userId)
+	if blocked == nil {
+		blocked = []primitive.ObjectID{}
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "login", Value: primitive.Regex{Pattern: pattern, Options: "i"}},
+			{Key: "_id", Value: bson.D{{Key: "$nin", Value: blocked}}},
+			{Key: "blocked_array", Value: bson.D{{Key: "$ne", Value: userId}}},
+		}}},
+		//Более короткие логины ближе к запросу
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "login_length", Value: bson.D{{Key: "$strLenCP", Value: "$login"}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "login_length", Value: 1}, {Key: "login", Value: 1}}}},
+		bson.D{{Key: "$skip", Value: offset}},
+		bson.D{{Key: "$limit", Value: limit}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "login_length", Value: 0}}}},
+	}
+	pipeline = append(pipeline, userLiteStages()...)
+
+	cur, err := d.collectionUsers.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	for cur.Next(context.TODO()) {
+		var elem structures.User_lite
+		err := cur.Decode(&elem)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		d.hidePrivateFields(user_id, &elem)
+		res = append(res, elem)
+	}
+
+	return res, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	"github.com/MUR4SH/MyMessenger/databaseInterface"
@@ -19,9 +20,12 @@ type Config struct {
 		ChatSettings     string `yaml:"chat_settings"`
 		ChatsArray       string `yaml:"chats_array"`
 		PersonalSettings string `yaml:"personal_settings"`
+		Events           string `yaml:"events"`
 	}
 	API struct {
-		Port string `yaml:"port"`
+		Port           string                       `yaml:"port"`
+		AllowedOrigins []string                     `yaml:"allowed_origins"`
+		WebSocket      serverAndHandlers.WsSettings `yaml:"websocket"`
 	} `yaml:"web"`
 }
 
@@ -51,5 +55,36 @@ func main() {
 		config.Database.PersonalSettings,
 	)
 
-	serverAndHandlers.InitServer(config.API.Port, &dbInterface)
+	//Служебные команды: go run . migrate | merge-personal-chats
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			err = dbInterface.Migrate()
+		case "merge-personal-chats":
+			err = dbInterface.MergePersonalChats()
+		default:
+			log.Fatal("unknown command: ", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//Журнал событий вебсокета для повтора после переподключения
+	ws := config.API.WebSocket
+	if ws.EventLogSize <= 0 {
+		ws.EventLogSize = serverAndHandlers.EVENT_LOG_SIZE
+	}
+	var events serverAndHandlers.EventStore
+	switch ws.EventStore {
+	case "mongo":
+		events = dbInterface.NewEventStore(config.Database.Events, ws.EventLogSize)
+	case "memory", "":
+		events = serverAndHandlers.NewMemoryEventStore(ws.EventLogSize)
+	default:
+		log.Fatal("unknown event_store: ", ws.EventStore)
+	}
+
+	serverAndHandlers.InitServer(config.API.Port, config.API.AllowedOrigins, ws, events, &dbInterface)
 }
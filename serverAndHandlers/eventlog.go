@@ -0,0 +1,169 @@
+package serverAndHandlers
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Размер журнала потока по умолчанию
+const EVENT_LOG_SIZE = 500
+
+//Журнал событий для повторной отправки после переподключения
+//Поток - чат (id чата) или пользователь (user:id), номера событий в потоке идут подряд с 1
+//Хранится только последний отрезок потока, при большем разрыве клиент синхронизируется заново
+type EventStore interface {
+	//Добавляем событие, encode получает присвоенный номер и возвращает JSON события
+	Append(stream string, encode func(seq int64) []byte) (int64, error)
+	//События после номера after, false - часть событий потеряна и нужна синхронизация
+	Since(stream string, after int64) ([][]byte, bool, error)
+	//Удаляем поток целиком
+	Drop(stream string) error
+}
+
+var eventStore EventStore
+
+//Поток личных событий пользователя
+func userStream(user_id string) string {
+	return "user:" + user_id
+}
+
+//Запись в журнал идет под блокировкой потока, чтобы номера присваивались по порядку
+//Простые события ставятся в очередь хаба под той же блокировкой и приходят в порядке номеров
+var streamLocks [64]sync.Mutex
+
+func lockStream(stream string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(stream))
+	return &streamLocks[h.Sum32()%uint32(len(streamLocks))]
+}
+
+//Записываем событие в журнал потока и возвращаем его JSON
+//Вызывается под блокировкой потока, ошибка журнала не мешает рассылке
+func recordEvent(stream string, event *structures.Event) []byte {
+	var b []byte
+	_, err := eventStore.Append(stream, func(seq int64) []byte {
+		event.Event_seq = seq
+		b, _ = json.Marshal(event)
+		return b
+	})
+	if err != nil || b == nil {
+		log.Println(err)
+		event.Event_seq = 0
+		b, _ = json.Marshal(event)
+	}
+	return b
+}
+
+//Повторно отправляем подключению события потока после after
+//Если события потеряны, отправляем resync, и клиент загружает данные заново
+//Пишем напрямую в очередь клиента с ожиданием, чтобы большой повтор не отключил его как медленного
+func replayStream(c *client, stream string, chat_id string, after int64) {
+	events, ok, err := eventStore.Since(stream, after)
+	if err != nil {
+		log.Println(err)
+	}
+	if err != nil || !ok {
+		b, _ := json.Marshal(structures.NewEvent(structures.EVENT_RESYNC, chat_id, 0, nil))
+		events = [][]byte{b}
+	}
+
+	for i := 0; i < len(events); i++ {
+		select {
+		case c.send <- events[i]:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//Журнал в памяти, теряется при перезапуске сервера
+type MemoryEventStore struct {
+	mutex   sync.Mutex
+	size    int
+	streams map[string]*memoryStream
+}
+
+type memoryStream struct {
+	first  int64 //Номер первого хранимого события
+	last   int64
+	events [][]byte
+}
+
+func NewMemoryEventStore(size int) *MemoryEventStore {
+	return &MemoryEventStore{
+		size:    size,
+		streams: make(map[string]*memoryStream),
+	}
+}
+
+func (s *MemoryEventStore) Append(stream string, encode func(seq int64) []byte) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.streams[stream]
+	if !ok {
+		st = &memoryStream{first: 1}
+		s.streams[stream] = st
+	}
+
+	st.last++
+	st.events = append(st.events, encode(st.last))
+	if len(st.events) > s.size {
+		st.events = st.events[len(st.events)-s.size:]
+		st.first = st.last - int64(s.size) + 1
+	}
+	return st.last, nil
+}
+
+func (s *MemoryEventStore) Since(stream string, after int64) ([][]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.streams[stream]
+	if !ok {
+		//Клиент видел события, которых журнал не знает: поток удален или сервер перезапущен
+		return nil, after == 0, nil
+	}
+	if after > st.last || after < st.first-1 {
+		return nil, false, nil
+	}
+
+	res := make([][]byte, len(st.events[after-st.first+1:]))
+	copy(res, st.events[after-st.first+1:])
+	return res, true, nil
+}
+
+func (s *MemoryEventStore) Drop(stream string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.streams, stream)
+	return nil
+}
+
+//Обрабатываем кадр resume: повторяем пропущенные события чатов и личные события
+func handleResume(c *client, frame structures.ClientFrame) {
+	var p structures.ResumePayload
+	err := json.Unmarshal(frame.Payload, &p)
+	if err != nil {
+		sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_INVALID, Frame: frame.Type})
+		return
+	}
+
+	if p.User != nil {
+		replayStream(c, userStream(c.user_id), "", *p.User)
+	}
+	for chat_id, after := range p.Chats {
+		//Из чужих и удаленных чатов ничего не повторяем, клиент узнает о них при синхронизации
+		if !dbInterface.UserInChat(c.user_id, chat_id) {
+			b, _ := json.Marshal(structures.NewEvent(structures.EVENT_RESYNC, chat_id, 0, nil))
+			hub.sendToClient(c, b)
+			continue
+		}
+		replayStream(c, chat_id, chat_id, after)
+	}
+}
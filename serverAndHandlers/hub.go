@@ -0,0 +1,584 @@
+package serverAndHandlers
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+	"github.com/gorilla/websocket"
+)
+
+//Размер очереди отправки одного подключения
+//Клиент, не успевающий читать, отключается при переполнении очереди
+const SEND_QUEUE_SIZE = 256
+
+//Время на запись одного сообщения в подключение
+const WRITE_WAIT = 10 * time.Second
+
+//Настройки вебсокета
+//PingInterval - как часто сервер пингует клиента
+//PongWait - сколько ждать любого кадра от клиента, должно быть больше PingInterval
+//MaxMessageSize - максимальный размер кадра клиента в байтах
+//EventStore - где хранить журнал событий для повтора: memory или mongo
+//EventLogSize - сколько последних событий хранить в каждом потоке журнала
+type WsSettings struct {
+	PingInterval   time.Duration `yaml:"ping_interval"`
+	PongWait       time.Duration `yaml:"pong_wait"`
+	MaxMessageSize int64         `yaml:"max_message_size"`
+	EventStore     string        `yaml:"event_store"`
+	EventLogSize   int           `yaml:"event_log_size"`
+}
+
+var wsSettings = WsSettings{
+	PingInterval:   30 * time.Second,
+	PongWait:       60 * time.Second,
+	MaxMessageSize: 64 * 1024,
+}
+
+//Применяем настройки из конфига, незаданные значения остаются по умолчанию
+func configureWebSocket(settings WsSettings) {
+	if settings.PingInterval > 0 {
+		wsSettings.PingInterval = settings.PingInterval
+	}
+	if settings.PongWait > 0 {
+		wsSettings.PongWait = settings.PongWait
+	}
+	if settings.MaxMessageSize > 0 {
+		wsSettings.MaxMessageSize = settings.MaxMessageSize
+	}
+	if wsSettings.PongWait <= wsSettings.PingInterval {
+		log.Println("pong_wait must be greater than ping_interval, using ping_interval * 2")
+		wsSettings.PongWait = wsSettings.PingInterval * 2
+	}
+}
+
+//Метрики вебсокета, отдаются по /debug/vars
+var (
+	wsConnections      = expvar.NewInt("ws_connections")       //Открытые подключения
+	wsUsers            = expvar.NewInt("ws_users")             //Пользователи хотя бы с одним подключением
+	wsConnectionsTotal = expvar.NewInt("ws_connections_total") //Подключения за все время
+	wsDisconnects      = expvar.NewMap("ws_disconnects")       //Отключения по причинам
+)
+
+//Методы *websocket.Conn, которыми пользуется клиент, в тестах подменяются
+type wsConnection interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+//Подключение клиента по вебсокету
+//У пользователя может быть несколько подключений: вкладки, телефон и т.д.
+//Пишет в подключение только его собственная горутина writePump
+type client struct {
+	connection  wsConnection
+	user_id     string
+	token       string          //Токен сессии, по которой открыто подключение
+	device_id   string          //Устройство, задается клиентом, может быть пустым
+	last_typing time.Time       //Последний принятый typing.start, меняется только горутиной readPump
+	chats       []string        //Чаты, на которые подписано подключение при регистрации
+	send        chan []byte     //Очередь отправки, никогда не закрывается
+	done        chan struct{}   //Закрывается хабом при отключении клиента
+	reason      string          //Причина отключения, задается до закрытия done
+	close_code  int             //Код закрытия вебсокета, задается вместе с reason
+	subscribed  map[string]bool //Чаты подключения, меняется только горутиной хаба
+}
+
+func newClient(connection wsConnection, user_id string, token string, device_id string, chats []string) *client {
+	return &client{
+		connection: connection,
+		user_id:    user_id,
+		token:      token,
+		device_id:  device_id,
+		chats:      chats,
+		send:       make(chan []byte, SEND_QUEUE_SIZE),
+		done:       make(chan struct{}),
+		subscribed: make(map[string]bool),
+	}
+}
+
+//Пишем сообщения из очереди в подключение и пингуем клиента
+//При отключении отправляем причину и закрываем подключение
+func (c *client) writePump() {
+	ticker := time.NewTicker(wsSettings.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.connection.Close()
+	}()
+	for {
+		select {
+		case data := <-c.send:
+			c.connection.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			err := c.connection.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				log.Println(err)
+				hub.unregister <- c
+				<-c.done
+				return
+			}
+		case <-ticker.C:
+			c.connection.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			err := c.connection.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				hub.unregister <- c
+				<-c.done
+				return
+			}
+		case <-c.done:
+			c.connection.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.close_code, c.reason),
+				time.Now().Add(time.Second),
+			)
+			return
+		}
+	}
+}
+
+//Читаем кадры клиента, пока подключение живо
+//Любой кадр или понг продлевает срок ожидания, при ошибке чтения клиент отключается
+func (c *client) readPump() {
+	c.connection.SetReadLimit(wsSettings.MaxMessageSize)
+	c.connection.SetReadDeadline(time.Now().Add(wsSettings.PongWait))
+	c.connection.SetPongHandler(func(string) error {
+		return c.connection.SetReadDeadline(time.Now().Add(wsSettings.PongWait))
+	})
+
+	for {
+		_, data, err := c.connection.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
+			hub.unregister <- c
+			return
+		}
+		c.connection.SetReadDeadline(time.Now().Add(wsSettings.PongWait))
+		handleFrame(c, data)
+	}
+}
+
+//Обрабатываем кадр клиента, на ошибки отвечаем событием error
+func handleFrame(c *client, data []byte) {
+	var frame structures.ClientFrame
+	err := json.Unmarshal(data, &frame)
+	if err != nil || frame.Type == "" {
+		sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_INVALID})
+		return
+	}
+
+	switch frame.Type {
+	case structures.FRAME_SUBSCRIBE:
+		//Подписаться можно только на чаты, в которых состоит пользователь
+		if !dbInterface.UserInChat(c.user_id, frame.Chat_id) {
+			sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_FORBIDDEN, Frame: frame.Type})
+			return
+		}
+		hub.calls <- func() {
+			if hub.clients[c] {
+				hub.addToChat(c, frame.Chat_id)
+			}
+		}
+	case structures.FRAME_UNSUBSCRIBE:
+		hub.calls <- func() {
+			hub.removeFromChat(c, frame.Chat_id)
+		}
+	case structures.FRAME_MESSAGE_SEND:
+		handleMessageSend(c, frame)
+	case structures.FRAME_RESUME:
+		handleResume(c, frame)
+	case structures.FRAME_TYPING_START, structures.FRAME_TYPING_STOP:
+		handleTyping(c, frame)
+	default:
+		sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_UNKNOWN_TYPE, Frame: frame.Type})
+	}
+}
+
+//Отправка сообщения кадром, отвечаем подтверждением или ошибкой с тем же client_id
+func handleMessageSend(c *client, frame structures.ClientFrame) {
+	var p structures.MessageSendPayload
+	err := json.Unmarshal(frame.Payload, &p)
+	if err != nil || p.Client_id == "" || len(p.Text) == 0 {
+		sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_INVALID, Frame: frame.Type, Client_id: p.Client_id})
+		return
+	}
+
+	sent, err := sendChatMessage(c.user_id, c.device_id, structures.MessageJSON{
+		Chat_id:    frame.Chat_id,
+		Text:       p.Text,
+		Replied_id: p.Replied_id,
+		Client_id:  p.Client_id,
+	})
+	if err != nil {
+		sendFrameError(c, structures.ErrorPayload{Code: sendErrorCode(err), Frame: frame.Type, Client_id: p.Client_id})
+		return
+	}
+
+	b, _ := json.Marshal(structures.NewEvent(structures.EVENT_ACK, frame.Chat_id, sent.Seq, sentAck(p.Client_id, sent)))
+	hub.sendToClient(c, b)
+}
+
+func sendFrameError(c *client, payload structures.ErrorPayload) {
+	b, _ := json.Marshal(structures.NewEvent(structures.EVENT_ERROR, "", 0, payload))
+	hub.sendToClient(c, b)
+}
+
+//Подписка подключений пользователя на чат
+type subscription struct {
+	user_id string
+	chat_id string
+}
+
+//Сообщение для подписчиков чата или для подключений пользователя
+//Подключения устройства except_device и пользователя except_user сообщение не получают
+type hubMessage struct {
+	chat_id       string
+	user_id       string
+	except_device string
+	except_user   string
+	data          []byte
+}
+
+//Хаб вебсокет подключений
+//Все карты принадлежат горутине run, остальные горутины обращаются к хабу через каналы
+type Hub struct {
+	register    chan *client
+	unregister  chan *client
+	broadcast   chan hubMessage
+	subscribe   chan subscription
+	unsubscribe chan subscription
+	calls       chan func() //Прочие операции, выполняемые в горутине хаба
+
+	clients map[*client]bool
+	chats   map[string]map[*client]bool //Чат - подписанные подключения
+	users   map[string]map[*client]bool //Пользователь - его подключения
+}
+
+var hub *Hub
+
+func newHub() *Hub {
+	return &Hub{
+		register:    make(chan *client),
+		unregister:  make(chan *client, SEND_QUEUE_SIZE),
+		broadcast:   make(chan hubMessage, SEND_QUEUE_SIZE),
+		subscribe:   make(chan subscription),
+		unsubscribe: make(chan subscription),
+		calls:       make(chan func()),
+		clients:     make(map[*client]bool),
+		chats:       make(map[string]map[*client]bool),
+		users:       make(map[string]map[*client]bool),
+	}
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			//Сессию могли отозвать, пока подключение открывалось
+			//closeToken вызывается после удаления сессии, поэтому проверки здесь достаточно
+			if !verifyToken(c.token) {
+				wsDisconnects.Add("session expired", 1)
+				c.reason = "session expired"
+				c.close_code = websocket.CloseNormalClosure
+				close(c.done)
+				go c.writePump()
+				continue
+			}
+			h.clients[c] = true
+			if h.users[c.user_id] == nil {
+				h.users[c.user_id] = make(map[*client]bool)
+			}
+			h.users[c.user_id][c] = true
+			for i := 0; i < len(c.chats); i++ {
+				h.addToChat(c, c.chats[i])
+			}
+			wsConnections.Add(1)
+			wsConnectionsTotal.Add(1)
+			if len(h.users[c.user_id]) == 1 {
+				wsUsers.Add(1)
+				queuePresence(c.user_id, true)
+			}
+			go c.writePump()
+		case c := <-h.unregister:
+			h.remove(c, websocket.CloseNormalClosure, "closed")
+		case m := <-h.broadcast:
+			var targets map[*client]bool
+			if m.chat_id != "" {
+				targets = h.chats[m.chat_id]
+			} else {
+				targets = h.users[m.user_id]
+			}
+			for c := range targets {
+				if m.except_device != "" && c.device_id == m.except_device {
+					continue
+				}
+				if m.except_user != "" && c.user_id == m.except_user {
+					continue
+				}
+				h.enqueue(c, m.data)
+			}
+		case s := <-h.subscribe:
+			for c := range h.users[s.user_id] {
+				h.addToChat(c, s.chat_id)
+			}
+		case s := <-h.unsubscribe:
+			for c := range h.users[s.user_id] {
+				h.removeFromChat(c, s.chat_id)
+			}
+		case f := <-h.calls:
+			f()
+		}
+	}
+}
+
+func (h *Hub) addToChat(c *client, chat_id string) {
+	if h.chats[chat_id] == nil {
+		h.chats[chat_id] = make(map[*client]bool)
+	}
+	h.chats[chat_id][c] = true
+	c.subscribed[chat_id] = true
+}
+
+func (h *Hub) removeFromChat(c *client, chat_id string) {
+	delete(h.chats[chat_id], c)
+	if len(h.chats[chat_id]) == 0 {
+		delete(h.chats, chat_id)
+	}
+	delete(c.subscribed, chat_id)
+}
+
+//Ставим сообщение в очередь клиента, переполненного клиента отключаем
+func (h *Hub) enqueue(c *client, data []byte) {
+	if !h.clients[c] {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		log.Println("Slow websocket consumer evicted, user " + c.user_id)
+		h.remove(c, websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+//Удаляем клиента из хаба и останавливаем его горутину записи
+//code - код закрытия: ClosePolicyViolation только при принудительном отключении клиента
+func (h *Hub) remove(c *client, code int, reason string) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	for chat_id := range c.subscribed {
+		h.removeFromChat(c, chat_id)
+	}
+	delete(h.users[c.user_id], c)
+	if len(h.users[c.user_id]) == 0 {
+		delete(h.users, c.user_id)
+		wsUsers.Add(-1)
+		queuePresence(c.user_id, false)
+	}
+	wsConnections.Add(-1)
+	wsDisconnects.Add(reason, 1)
+
+	c.reason = reason
+	c.close_code = code
+	close(c.done)
+}
+
+//Выполняем функцию в горутине хаба и ждем ее завершения
+func (h *Hub) call(f func()) {
+	finished := make(chan struct{})
+	h.calls <- func() {
+		f()
+		close(finished)
+	}
+	<-finished
+}
+
+//Отправляем данные всем подписчикам чата
+func (h *Hub) sendToChat(chat_id string, data []byte) {
+	h.broadcast <- hubMessage{chat_id: chat_id, data: data}
+}
+
+//Отправляем данные подписчикам чата, кроме подключений пользователя user_id
+func (h *Hub) sendToChatExcept(chat_id string, user_id string, data []byte) {
+	h.broadcast <- hubMessage{chat_id: chat_id, except_user: user_id, data: data}
+}
+
+//Отправляем данные всем подключениям пользователя
+func (h *Hub) sendToUser(user_id string, data []byte) {
+	h.broadcast <- hubMessage{user_id: user_id, data: data}
+}
+
+//Отправляем данные подключениям пользователя, кроме устройства device_id
+func (h *Hub) sendToOtherDevices(user_id string, device_id string, data []byte) {
+	h.broadcast <- hubMessage{user_id: user_id, except_device: device_id, data: data}
+}
+
+//Отправляем данные одному подключению
+func (h *Hub) sendToClient(c *client, data []byte) {
+	h.calls <- func() {
+		h.enqueue(c, data)
+	}
+}
+
+//Получаем подписчиков чата
+func (h *Hub) chatClients(chat_id string) []*client {
+	var res []*client
+	h.call(func() {
+		for c := range h.chats[chat_id] {
+			res = append(res, c)
+		}
+	})
+	return res
+}
+
+//Получаем пользователей, подписанных на чаты, кроме except_user
+func (h *Hub) chatsUsers(chats []string, except_user string) []string {
+	var res []string
+	h.call(func() {
+		seen := map[string]bool{except_user: true}
+		for i := 0; i < len(chats); i++ {
+			for c := range h.chats[chats[i]] {
+				if !seen[c.user_id] {
+					seen[c.user_id] = true
+					res = append(res, c.user_id)
+				}
+			}
+		}
+	})
+	return res
+}
+
+//Проверяем, есть ли у пользователя живые подключения
+func (h *Hub) isOnline(user_id string) bool {
+	var res bool
+	h.call(func() {
+		res = len(h.users[user_id]) > 0
+	})
+	return res
+}
+
+//Закрываем подключения, открытые по токену сессии
+//Отзыв сессии - штатное закрытие, клиент должен авторизоваться заново
+func (h *Hub) closeToken(token string, reason string) {
+	h.calls <- func() {
+		for c := range h.clients {
+			if c.token == token {
+				h.remove(c, websocket.CloseNormalClosure, reason)
+			}
+		}
+	}
+}
+
+//Закрываем все подключения пользователя
+func (h *Hub) closeUser(user_id string, reason string) {
+	h.calls <- func() {
+		for c := range h.users[user_id] {
+			h.remove(c, websocket.CloseNormalClosure, reason)
+		}
+	}
+}
+
+//Отписываем всех от удаленного чата
+func (h *Hub) dropChat(chat_id string) {
+	h.calls <- func() {
+		for c := range h.chats[chat_id] {
+			h.removeFromChat(c, chat_id)
+		}
+	}
+}
+
+//Отправляем событие пользователю, если он подключен по вебсокету
+//Событие записывается в журнал личных событий пользователя
+func sendEvent(user_id string, event structures.Event) {
+	stream := userStream(user_id)
+	lock := lockStream(stream)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hub.sendToUser(user_id, recordEvent(stream, &event))
+}
+
+//Отправляем событие остальным устройствам пользователя
+func syncEvent(user_id string, device_id string, event structures.Event) {
+	stream := userStream(user_id)
+	lock := lockStream(stream)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hub.sendToOtherDevices(user_id, device_id, recordEvent(stream, &event))
+}
+
+//Отправляем событие всем подключенным участникам чата
+//Событие записывается в журнал чата
+func sendChatEvent(chat_id string, event structures.Event) {
+	lock := lockStream(chat_id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hub.sendToChat(chat_id, recordEvent(chat_id, &event))
+}
+
+//Сообщаем подключенным участникам чата о сообщении, включая остальные устройства отправителя
+//Сообщение целиком получают только те, кто может его видеть
+//device_id - устройство, с которого отправлено сообщение
+//Под блокировкой потока только присваиваем номер и пишем в журнал, проверки в бд и рассылка идут после,
+//поэтому события одного чата могут прийти не по порядку, клиент упорядочивает их по event_seq
+func publishMessage(event_type string, user_id string, device_id string, chat_id string, message_id string) {
+	msg, err := dbInterface.GetMessage(user_id, message_id, chat_id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	//В журнал пишется полное событие, при повторе его получают только участники чата
+	payload := structures.MessagePayload{Message_id: message_id, Device_id: device_id}
+	event := structures.NewEvent(event_type, chat_id, msg.Seq, payload)
+	if err == nil {
+		event.Payload = structures.MessagePayload{Message_id: message_id, Message: &msg, Device_id: device_id}
+	}
+	lock := lockStream(chat_id)
+	lock.Lock()
+	full := recordEvent(chat_id, &event)
+	lock.Unlock()
+
+	//Остальным подписчикам то же событие с тем же номером, но без сообщения
+	event.Payload = payload
+	hidden, _ := json.Marshal(event)
+
+	//Участие проверяем один раз на пользователя, а не на каждое подключение
+	clients := hub.chatClients(chat_id)
+	visible := make(map[string]bool)
+	for i := 0; i < len(clients); i++ {
+		if _, ok := visible[clients[i].user_id]; !ok {
+			visible[clients[i].user_id] = err == nil && dbInterface.UserInChat(clients[i].user_id, chat_id)
+		}
+	}
+
+	hub.calls <- func() {
+		for i := 0; i < len(clients); i++ {
+			if visible[clients[i].user_id] {
+				hub.enqueue(clients[i], full)
+			} else {
+				hub.enqueue(clients[i], hidden)
+			}
+		}
+	}
+}
+
+//Подписываем подключения пользователя на чат
+//Вызывается при любом вступлении в чат, чтобы живые подключения получали его события
+func subscribeUser(user_id string, chat_id string) {
+	hub.subscribe <- subscription{user_id: user_id, chat_id: chat_id}
+}
+
+//Отписываем подключения пользователя от чата
+func unsubscribeUser(user_id string, chat_id string) {
+	hub.unsubscribe <- subscription{user_id: user_id, chat_id: chat_id}
+}
@@ -0,0 +1,220 @@
+package serverAndHandlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+	"github.com/gorilla/websocket"
+)
+
+//Подключение без сети: запись копится в памяти, block задерживает запись сообщений
+type fakeConnection struct {
+	mutex    sync.Mutex
+	messages [][]byte
+	closed   chan struct{}
+	block    chan struct{} //Пока канал не закрыт, WriteMessage висит, nil - не висит
+	once     sync.Once
+}
+
+func newFakeConnection(block chan struct{}) *fakeConnection {
+	return &fakeConnection{closed: make(chan struct{}), block: block}
+}
+
+func (f *fakeConnection) ReadMessage() (int, []byte, error) {
+	<-f.closed
+	return 0, nil, errors.New("closed")
+}
+
+func (f *fakeConnection) WriteMessage(messageType int, data []byte) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.messages = append(f.messages, data)
+	return nil
+}
+
+func (f *fakeConnection) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+func (f *fakeConnection) SetReadLimit(limit int64)                    {}
+func (f *fakeConnection) SetReadDeadline(t time.Time) error           { return nil }
+func (f *fakeConnection) SetWriteDeadline(t time.Time) error          { return nil }
+func (f *fakeConnection) SetPongHandler(h func(appData string) error) {}
+
+func (f *fakeConnection) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeConnection) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.messages)
+}
+
+//Запускаем новый хаб и заводим сессии для токенов
+func startTestHub(t *testing.T, tokens map[string]string) {
+	hub = newHub()
+	go hub.run()
+
+	sessionsMutex.Lock()
+	users = make(map[string]structures.TokenStore)
+	delete_users = make(map[int64][]string)
+	for token, user_id := range tokens {
+		users[token] = structures.TokenStore{Id: user_id, Date: time.Now().UTC()}
+	}
+	sessionsMutex.Unlock()
+}
+
+func waitClosed(t *testing.T, f *fakeConnection) {
+	select {
+	case <-f.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+//Проверяем, что в хабе не осталось подключений, подписок и пользователей
+func checkHubEmpty(t *testing.T) {
+	var clients, chats, usersCount int
+	hub.call(func() {
+		clients = len(hub.clients)
+		chats = len(hub.chats)
+		usersCount = len(hub.users)
+	})
+	if clients != 0 || chats != 0 || usersCount != 0 {
+		t.Errorf("hub leaked: %d clients, %d chats, %d users", clients, chats, usersCount)
+	}
+}
+
+func TestHubConcurrentLoad(t *testing.T) {
+	const clientsCount = 50
+	const rounds = 20
+
+	tokens := make(map[string]string)
+	for i := 0; i < clientsCount; i++ {
+		//Несколько подключений на пользователя
+		tokens[fmt.Sprint("token", i)] = fmt.Sprint("user", i%10)
+	}
+	startTestHub(t, tokens)
+
+	connections := make([]*fakeConnection, clientsCount)
+	var wg sync.WaitGroup
+	for i := 0; i < clientsCount; i++ {
+		connections[i] = newFakeConnection(nil)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user_id := fmt.Sprint("user", i%10)
+			c := newClient(connections[i], user_id, fmt.Sprint("token", i), fmt.Sprint("device", i), []string{fmt.Sprint("chat", i%5)})
+			hub.register <- c
+
+			for j := 0; j < rounds; j++ {
+				chat_id := fmt.Sprint("chat", (i+j)%5)
+				//Так же, как кадр subscribe
+				hub.calls <- func() {
+					if hub.clients[c] {
+						hub.addToChat(c, chat_id)
+					}
+				}
+				subscribeUser(user_id, chat_id)
+				hub.sendToChat(chat_id, []byte("chat"))
+				hub.sendToChatExcept(chat_id, user_id, []byte("except"))
+				hub.sendToUser(user_id, []byte("user"))
+				hub.sendToOtherDevices(user_id, c.device_id, []byte("device"))
+				hub.sendToClient(c, []byte("client"))
+				hub.chatClients(chat_id)
+				hub.isOnline(user_id)
+				unsubscribeUser(user_id, chat_id)
+			}
+
+			//Часть подключений закрывается по сессии или пользователю
+			switch i % 3 {
+			case 0:
+				hub.unregister <- c
+			case 1:
+				hub.closeToken(c.token, "session expired")
+			case 2:
+				hub.closeUser(user_id, "account deleted")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < clientsCount; i++ {
+		waitClosed(t, connections[i])
+	}
+	checkHubEmpty(t)
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	startTestHub(t, map[string]string{"slow": "user1", "fast": "user2"})
+
+	block := make(chan struct{})
+	defer close(block)
+	slowConnection := newFakeConnection(block)
+	slow := newClient(slowConnection, "user1", "slow", "", []string{"slow_chat", "shared"})
+	fastConnection := newFakeConnection(nil)
+	fast := newClient(fastConnection, "user2", "fast", "", []string{"fast_chat", "shared"})
+	hub.register <- slow
+	hub.register <- fast
+
+	//Одно сообщение висит в записи, остальные заполняют очередь, следующее переполняет ее
+	for i := 0; i < SEND_QUEUE_SIZE+2; i++ {
+		hub.sendToChat("slow_chat", []byte("message"))
+	}
+
+	select {
+	case <-slow.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow consumer was not evicted")
+	}
+	if slow.reason != "slow consumer" || slow.close_code != websocket.ClosePolicyViolation {
+		t.Errorf("closed with %d %q, want %d %q", slow.close_code, slow.reason, websocket.ClosePolicyViolation, "slow consumer")
+	}
+
+	var registered, subscribed, online bool
+	hub.call(func() {
+		registered = hub.clients[slow]
+		subscribed = hub.chats["slow_chat"] != nil || hub.chats["shared"][slow]
+		online = len(hub.users["user1"]) > 0
+	})
+	if registered || subscribed || online {
+		t.Errorf("evicted client left in hub: registered %v, subscribed %v, online %v", registered, subscribed, online)
+	}
+
+	//Остальные подключения продолжают получать сообщения
+	hub.sendToChat("shared", []byte("message"))
+	deadline := time.Now().Add(5 * time.Second)
+	for fastConnection.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("fast client didn't receive message after eviction")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	hub.unregister <- fast
+	waitClosed(t, fastConnection)
+	checkHubEmpty(t)
+}
+
+func TestHubRegisterRevokedSession(t *testing.T) {
+	startTestHub(t, map[string]string{})
+
+	connection := newFakeConnection(nil)
+	c := newClient(connection, "user1", "revoked", "", []string{"chat"})
+	hub.register <- c
+
+	waitClosed(t, connection)
+	if c.reason != "session expired" || c.close_code != websocket.CloseNormalClosure {
+		t.Errorf("closed with %d %q, want %d %q", c.close_code, c.reason, websocket.CloseNormalClosure, "session expired")
+	}
+	checkHubEmpty(t)
+}
@@ -0,0 +1,84 @@
+package serverAndHandlers
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Изменение присутствия пользователя
+//Хаб ставит его в очередь, когда у пользователя появляется первое или пропадает последнее подключение
+type presenceChange struct {
+	user_id string
+	online  bool
+	date    time.Time
+}
+
+//Последние необработанные изменения присутствия по пользователям
+//Хаб не ждет обработки, а изменения не теряются: из нескольких изменений пользователя остается последнее
+var presenceMutex sync.Mutex
+var presencePending = make(map[string]presenceChange)
+
+//Будим горутину присутствия, если есть необработанные изменения
+var presenceWake = make(chan struct{}, 1)
+
+//Запоминаем время последнего входа и рассылаем присутствие пользователям с общими чатами
+//Получатели фильтруются по настройке видимости времени последнего входа
+func runPresence() {
+	for range presenceWake {
+		presenceMutex.Lock()
+		pending := presencePending
+		presencePending = make(map[string]presenceChange)
+		presenceMutex.Unlock()
+
+		for _, p := range pending {
+			publishPresence(p)
+		}
+	}
+}
+
+//Сохраняем и рассылаем одно изменение присутствия
+func publishPresence(p presenceChange) {
+	if !p.online {
+		err := dbInterface.SetLastSeen(p.user_id, p.date)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	re, err := dbInterface.GetUsersChatsId(p.user_id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var chats []string
+	for i := 0; i < len(re); i++ {
+		chats = append(chats, re[i].Chat_id.Hex())
+	}
+
+	payload := structures.PresencePayload{User_id: p.user_id, Online: p.online}
+	if !p.online {
+		payload.Last_seen = structures.Date(p.date)
+	}
+	b, _ := json.Marshal(structures.NewEvent(structures.EVENT_PRESENCE, "", 0, payload))
+
+	viewers := dbInterface.LastSeenViewers(p.user_id, hub.chatsUsers(chats, p.user_id))
+	for i := 0; i < len(viewers); i++ {
+		hub.sendToUser(viewers[i], b)
+	}
+}
+
+//Запоминаем изменение присутствия, не блокируя хаб
+func queuePresence(user_id string, online bool) {
+	presenceMutex.Lock()
+	presencePending[user_id] = presenceChange{user_id: user_id, online: online, date: time.Now().UTC()}
+	presenceMutex.Unlock()
+
+	select {
+	case presenceWake <- struct{}{}:
+	default:
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	mrand "math/rand"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/MUR4SH/MyMessenger/databaseInterface"
@@ -22,30 +24,46 @@ import (
 //Карта авторизованных пользователей строка - токен, значение - id
 var users map[string]structures.TokenStore
 
-//Карта времени удаления пользователей, где ключ - время создания, значение - массив токенов
-var delete_users map[string][]string
+//Карта времени удаления пользователей, где ключ - час создания, значение - массив токенов
+var delete_users map[int64][]string
+
+//Защищает users, delete_users и wsTickets, к ним обращаются все HTTP горутины
+var sessionsMutex sync.Mutex
 
 var dbInterface *databaseInterface.DatabaseInterface
 
 const COOKIE_NAME = "token"
+const DEVICE_HEADER = "X-Device-Id" //Устройство клиента, нужно для синхронизации устройств
 const NOT_DONE = 501
 const NOT_AUTHORISED = 200
 const NOT_FOUND = 400
+const FORBIDDEN = 403
 const OK = 200
 
-const DATE_FORMAT = "2006-01-02 15"
+//Карта билетов на подключение по вебсокету
+var wsTickets map[string]structures.WsTicket
+
+//Время жизни билета на подключение по вебсокету
+const WS_TICKET_TTL = 30 * time.Second
 
-//Карта чат - пользователи
-var chatUsers map[string][]*websocket.Conn
-var userChats map[*websocket.Conn][]string
+//Максимальная длительность временного бана в секундах, больше - банить бессрочно
+const MAX_BAN_DURATION = 10 * 365 * 24 * 60 * 60
 
-//Карта id - connection
-var usersId map[string]*websocket.Conn
+//Origin, с которых разрешено подключение по вебсокету
+var allowedOrigins map[string]bool
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Пропускаем любой запрос
-	},
+	CheckOrigin: checkOrigin,
+}
+
+//Проверяем Origin по списку разрешенных
+//Запросы без Origin (не из браузера) пропускаем, их защищает авторизация
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return allowedOrigins[origin]
 }
 
 //Удаляем токены пользователей раз в час
@@ -53,33 +71,54 @@ func timeoutTokens() {
 	log.Print("Initiate deleting timeout tokens\n")
 	for {
 		log.Print("Deleting timeout tokens\n")
-		//Получаем дату создания записи методом текущая дата минус 23 часа
+		//Получаем час создания записи методом текущая дата минус 23 часа
 		//Чтобы не удалить только что созданные записи
-		pastDate := (time.Now().UTC().Add(-23 * time.Hour)).Format(DATE_FORMAT)
-		counter := 0
-
-		if arr, ok := delete_users[pastDate]; ok && len(arr) > 0 {
-			for i := 0; i < len(arr); i++ {
-				deleteUser(arr[i])
-				counter++
+		pastDate := sessionBucket(time.Now().UTC().Add(-23 * time.Hour))
+		var expired []string
+
+		sessionsMutex.Lock()
+		//Удаляем все записи, созданные не позже этого часа
+		for date, arr := range delete_users {
+			if date > pastDate {
+				continue
 			}
-			if len(delete_users[pastDate]) == 0 {
-				delete(delete_users, pastDate)
+			expired = append(expired, arr...)
+			delete(delete_users, date)
+		}
+		for i := 0; i < len(expired); i++ {
+			delete(users, expired[i])
+		}
+
+		//Удаляем просроченные билеты вебсокета
+		for ticket, t := range wsTickets {
+			if time.Now().UTC().After(t.Expires) {
+				delete(wsTickets, ticket)
 			}
 		}
+		sessionsMutex.Unlock()
+
+		//Закрываем вебсокеты истекших сессий
+		for i := 0; i < len(expired); i++ {
+			hub.closeToken(expired[i], "session expired")
+		}
 
-		log.Print(counter, " token(-s) has(-ve) been deleted\n")
+		log.Print(len(expired), " token(-s) has(-ve) been deleted\n")
 		//Ждем один час для повтора
 		time.Sleep(time.Hour)
 	}
 }
 
+//Час, в который создана запись сессии
+func sessionBucket(t time.Time) int64 {
+	return t.Unix() / int64(time.Hour/time.Second)
+}
+
 func enableCors(w *http.ResponseWriter, r string) {
 	(*w).Header().Set("Access-Control-Allow-Origin", r)
 	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
 	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 	(*w).Header().Set("Access-Control-Max-Age", "1000")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Access-Control-Allow-Headers, Origin, Accept, X-Requested-With, Content-Type, Access-Control-Request-Method, Access-Control-Request-Headers")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Access-Control-Allow-Headers, Origin, Accept, X-Requested-With, Content-Type, X-Device-Id, Access-Control-Request-Method, Access-Control-Request-Headers")
 }
 
 //Функция шифрования пароля
@@ -89,11 +128,11 @@ func GetSHA256Hash(text string) string {
 	return hex.EncodeToString(sha.Sum(nil))
 }
 
-//Обновляет токен
+//Обновляет токен, вызывается под sessionsMutex
 func updateToken(token string) {
-	date := (time.Now().UTC()).Format(DATE_FORMAT)
+	date := time.Now().UTC()
 
-	user_date := users[token].Date
+	user_date := sessionBucket(users[token].Date)
 	array := delete_users[user_date]
 	var new_array []string
 
@@ -101,7 +140,7 @@ func updateToken(token string) {
 	users[token] = structures.TokenStore{Id: users[token].Id, Date: date}
 
 	for i := 0; i < len(array); i++ {
-		if array[i] != users[token].Id {
+		if array[i] != token {
 			new_array = append(new_array, array[i])
 		}
 	}
@@ -110,26 +149,19 @@ func updateToken(token string) {
 	delete_users[user_date] = new_array
 
 	//Записываем в карту под новым ключом
-	if _, ok := delete_users[date]; ok {
-		delete_users[date] = append(delete_users[date], token)
-	} else {
-		delete_users[date] = []string{token}
-	}
+	delete_users[sessionBucket(date)] = append(delete_users[sessionBucket(date)], token)
 }
 
 //Создает запись в картах и возвращает токен, обёрнутый в json
 func createUser(id string) structures.TokenJson {
 	var t structures.TokenJson
 	t.Token = generateString()
-	date := (time.Now().UTC()).Format(DATE_FORMAT)
+	date := time.Now().UTC()
 
+	sessionsMutex.Lock()
 	users[t.Token] = structures.TokenStore{Id: id, Date: date}
-
-	if _, ok := delete_users[date]; ok {
-		delete_users[date] = append(delete_users[date], t.Token)
-	} else {
-		delete_users[date] = []string{t.Token}
-	}
+	delete_users[sessionBucket(date)] = append(delete_users[sessionBucket(date)], t.Token)
+	sessionsMutex.Unlock()
 
 	return t
 }
@@ -139,52 +171,45 @@ func verifyTokenCookie(c *http.Cookie, e error) bool {
 	if c == nil {
 		return false
 	}
-	token := c.Value
-
-	if token != "" {
-		if _, ok := users[token]; ok {
-
-			a, _ := time.Parse(DATE_FORMAT, users[token].Date)
-			d := (time.Since(a)).Hours()
-			if d >= 12 {
-				updateToken(token)
-			}
-
-			return true
-		}
-	}
-	return false
+	return verifyToken(c.Value)
 }
 
-//Функция проверки токена из кук
-func verifyToken(c string) bool {
-	if c == "" {
+//Функция проверки токена
+func verifyToken(token string) bool {
+	if token == "" {
 		return false
 	}
-	token := c
 
-	if token != "" {
-		if _, ok := users[token]; ok {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
 
-			a, _ := time.Parse(DATE_FORMAT, users[token].Date)
-			d := (time.Since(a)).Hours()
-			if d >= 12 {
-				updateToken(token)
-			}
+	if _, ok := users[token]; ok {
 
-			return true
+		d := (time.Since(users[token].Date)).Hours()
+		if d >= 12 {
+			updateToken(token)
 		}
+
+		return true
 	}
 	return false
 }
 
+//Получаем id пользователя сессии
+func sessionUser(token string) string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return users[token].Id
+}
+
 func deleteUser(token string) {
-	date := users[token].Date
+	sessionsMutex.Lock()
+	date := sessionBucket(users[token].Date)
 	array := delete_users[date]
 	var new_array []string
 
 	for i := 0; i < len(array); i++ {
-		if array[i] != users[token].Id {
+		if array[i] != token {
 			new_array = append(new_array, array[i])
 		}
 	}
@@ -193,6 +218,10 @@ func deleteUser(token string) {
 	delete_users[date] = new_array
 	//Удаляем из карты пользователей
 	delete(users, token)
+	sessionsMutex.Unlock()
+
+	//Закрываем вебсокеты, открытые по этой сессии
+	hub.closeToken(token, "session expired")
 }
 
 //Получаем токен из куки и удаляем пользователя
@@ -240,7 +269,7 @@ func getUsersOfChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	c, _ := r.Cookie(COOKIE_NAME)
-	arr, _ := dbInterface.GetUsersOfChat(users[c.Value].Id, r.URL.Query().Get("chat_id"), limit, offset)
+	arr, _ := dbInterface.GetUsersOfChat(sessionUser(c.Value), r.URL.Query().Get("chat_id"), limit, offset)
 	b, _ := json.Marshal(arr)
 	w.WriteHeader(OK)
 	fmt.Fprintf(w, string(b))
@@ -289,7 +318,7 @@ func getUsersChats(w http.ResponseWriter, r *http.Request) {
 	c, _ := r.Cookie(COOKIE_NAME)
 
 	arr, err := dbInterface.GetUsersChats(
-		users[c.Value].Id,
+		sessionUser(c.Value),
 		limit,
 		offset,
 	)
@@ -331,7 +360,7 @@ func getChatLite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	arr, err := dbInterface.GetChat(users[c.Value].Id, r.URL.Query().Get("chat_id"))
+	arr, err := dbInterface.GetChat(sessionUser(c.Value), r.URL.Query().Get("chat_id"))
 	if err != nil {
 		answ.Text = err.Error()
 		b, _ := json.Marshal(answ)
@@ -366,25 +395,47 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
-	if err != nil {
-		answ.Text = "offset error"
+	limit := 0
+	var err error
+	if r.URL.Query().Has("limit") {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			answ.Text = "limit error"
+			b, _ := json.Marshal(answ)
+			w.WriteHeader(NOT_DONE)
+			fmt.Fprintf(w, string(b))
+			return
+		}
+	}
+
+	before, errBefore := parseCursor(r, "before")
+	after, errAfter := parseCursor(r, "after")
+	around, errAround := parseCursor(r, "around")
+	if errBefore != nil || errAfter != nil || errAround != nil {
+		answ.Text = "cursor error"
 		b, _ := json.Marshal(answ)
 		w.WriteHeader(NOT_DONE)
 		fmt.Fprintf(w, string(b))
 		return
 	}
 
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-	if err != nil {
-		answ.Text = "limit error"
+	//Можно передать только один курсор
+	cursors := 0
+	for _, v := range []int64{before, after, around} {
+		if v >= 0 {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		answ.Text = "only one of before, after, around allowed"
 		b, _ := json.Marshal(answ)
 		w.WriteHeader(NOT_DONE)
 		fmt.Fprintf(w, string(b))
 		return
 	}
+
 	c, _ := r.Cookie(COOKIE_NAME)
-	arr, err := dbInterface.GetMessages(users[c.Value].Id, r.URL.Query().Get("chat_id"), limit, offset)
+	page, err := dbInterface.GetMessages(sessionUser(c.Value), r.URL.Query().Get("chat_id"), limit, before, after, around)
 	if err != nil {
 		answ.Text = err.Error()
 		b, _ := json.Marshal(answ)
@@ -392,9 +443,50 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, string(b))
 		return
 	}
-	b, _ := json.Marshal(arr)
+	b, _ := json.Marshal(page)
 	w.WriteHeader(OK)
 	fmt.Fprintf(w, string(b))
+
+	syncReadState(sessionUser(c.Value), r.Header.Get(DEVICE_HEADER), r.URL.Query().Get("chat_id"))
+}
+
+//Сообщаем остальным устройствам пользователя новый номер прочтения чата
+func syncReadState(user_id string, device_id string, chat_id string) {
+	chat, err := dbInterface.GetUsersChat(user_id, chat_id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	syncEvent(user_id, device_id, structures.NewEvent(structures.EVENT_CHAT_READ, chat_id, 0, structures.ReadPayload{
+		Last_read_seq: chat.Last_read_seq,
+		Device_id:     device_id,
+	}))
+}
+
+//Получаем курсор из запроса, -1 - курсор не передан
+//Курсор 0 допустим: after=0 - сообщения с самого начала, в том числе в пустом чате
+func parseCursor(r *http.Request, name string) (int64, error) {
+	if !r.URL.Query().Has(name) {
+		return -1, nil
+	}
+
+	cursor, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil || cursor < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+
+	return cursor, nil
+}
+
+//Генерация билета вебсокета
+//Билет заменяет куку при подключении, поэтому нужен криптографически стойкий генератор
+func generateTicket() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 //Генерация токена
@@ -408,11 +500,9 @@ func generateString() string {
 			random := mrand.Intn(len(charSet))
 			str += string(charSet[random])
 		}
-		if _, ok := users[str]; ok {
-			bl = true
-		} else {
-			bl = false
-		}
+		sessionsMutex.Lock()
+		_, bl = users[str]
+		sessionsMutex.Unlock()
 	}
 	return str
 }
@@ -543,15 +633,13 @@ func verifyTokenReq(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cookie, _ := r.Cookie(COOKIE_NAME)
-	var verify bool
-	if cookie == nil {
-		verify = verifyToken(m.Token)
-	} else {
-		verify = verifyTokenCookie(r.Cookie(COOKIE_NAME))
+	token := m.Token
+	if cookie != nil {
+		token = cookie.Value
 	}
 
-	if verify {
-		answ.Text = users[cookie.Value].Id
+	if verifyToken(token) {
+		answ.Text = sessionUser(token)
 		log.Printf("id")
 		log.Printf(answ.Text)
 		bs, _ := json.Marshal(answ)
@@ -603,22 +691,66 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 
 	c, _ := r.Cookie(COOKIE_NAME)
 
-	res, err := dbInterface.SendMessage(m.Chat_id, users[c.Value].Id, m.Text)
-	if err != nil && !res {
-		answ.Text = "NOT_AUTHORISED"
+	sent, err := sendChatMessage(sessionUser(c.Value), r.Header.Get(DEVICE_HEADER), m)
+	if errors.Is(err, databaseInterface.ErrNoWritePermission) {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(FORBIDDEN)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+	if err != nil {
+		answ.Text = err.Error()
 		bs, _ := json.Marshal(answ)
 		w.WriteHeader(OK)
 		fmt.Fprintf(w, string(bs))
 		return
 	}
-	answ.Text = "success"
-	bs, _ := json.Marshal(answ)
+	bs, _ := json.Marshal(sentAck(m.Client_id, sent))
 
 	w.WriteHeader(OK)
 	fmt.Fprintf(w, string(bs))
+}
+
+//Отправляем сообщение и рассылаем его подключенным участникам чата
+//Общий путь для POST /sendMessage и кадра message.send
+//Повторная отправка с тем же client_id не рассылается второй раз
+func sendChatMessage(user_id string, device_id string, m structures.MessageJSON) (structures.SentMessage, error) {
+	sent, err := dbInterface.SendMessage(m.Chat_id, user_id, m.Text, m.Replied_id, m.Client_id)
+	if err != nil && sent.Id == "" {
+		return sent, err
+	}
+	if err != nil {
+		//Сообщение сохранено, не удалось только добавить его в комментарии
+		log.Println(err)
+	}
+
+	if !sent.Duplicate {
+		//Сообщение отправлено, индикатор набора больше не нужен
+		stopTyping(typingKey{chat_id: m.Chat_id, user_id: user_id})
+		publishMessage(structures.EVENT_MESSAGE_CREATED, user_id, device_id, m.Chat_id, sent.Id)
+	}
+	return sent, nil
+}
 
-	for i := 0; i < len(chatUsers[m.Chat_id]); i++ {
-		chatUsers[m.Chat_id][i].WriteMessage(websocket.TextMessage, []byte(m.Chat_id))
+func sentAck(client_id string, sent structures.SentMessage) structures.AckPayload {
+	return structures.AckPayload{
+		Client_id:  client_id,
+		Message_id: sent.Id,
+		Seq:        sent.Seq,
+		Duplicate:  sent.Duplicate,
+	}
+}
+
+//Код ошибки отправки сообщения для кадра error
+func sendErrorCode(err error) string {
+	switch {
+	case errors.Is(err, databaseInterface.ErrNoWritePermission):
+		return structures.FRAME_FORBIDDEN
+	case errors.Is(err, databaseInterface.ErrMessageTooLong):
+		return structures.FRAME_MESSAGE_TOO_LONG
+	default:
+		return structures.FRAME_SEND_FAILED
 	}
 }
 
@@ -664,15 +796,16 @@ func createChat(w http.ResponseWriter, r *http.Request) {
 
 	if m.Logo != nil {
 		//TODO процесс преобразования файла и его сохранение в директорию files
-		logo_id, err = dbInterface.CreateFile(users[c.Value].Id, m.Logo, m.Logo_url)
+		logo_id, err = dbInterface.CreateFile(sessionUser(c.Value), m.Logo, m.Logo_url)
 	}
 
 	key, _ := rsa.GenerateKey(rand.Reader, 2048)
 
 	//Создаем чат (файл)
-	res, err := dbInterface.CreateChat(
-		users[c.Value].Id,
+	res, created, err := dbInterface.CreateChat(
+		sessionUser(c.Value),
 		m.Name,
+		m.Description,
 		logo_id,
 		m.Users,
 		*key,          //Приватный ключ
@@ -682,6 +815,7 @@ func createChat(w http.ResponseWriter, r *http.Request) {
 		m.Resend,
 		m.Users_write_permission,
 		m.Personal,
+		m.Channel,
 	)
 	if err != nil {
 		answ.Text = err.Error()
@@ -695,6 +829,21 @@ func createChat(w http.ResponseWriter, r *http.Request) {
 	bs, _ := json.Marshal(answ)
 	w.WriteHeader(OK)
 	fmt.Fprintf(w, string(bs))
+
+	//Персональный чат уже существовал, его участники не менялись
+	if !created {
+		return
+	}
+
+	//Подписываем живые подключения создателя и участников на новый чат
+	subscribeUser(sessionUser(c.Value), res)
+	for i := 0; i < len(m.Users); i++ {
+		subscribeUser(m.Users[i], res)
+		sendChatEvent(res, structures.NewEvent(structures.EVENT_MEMBER_JOINED, res, 0, structures.MemberPayload{
+			User_id:  m.Users[i],
+			Actor_id: sessionUser(c.Value),
+		}))
+	}
 }
 
 func getChatKey(w http.ResponseWriter, r *http.Request) {
@@ -721,7 +870,7 @@ func getChatKey(w http.ResponseWriter, r *http.Request) {
 
 	c, _ := r.Cookie(COOKIE_NAME)
 
-	res, err := dbInterface.GetUsersKey(users[c.Value].Id, r.URL.Query().Get("chat_id"))
+	res, err := dbInterface.GetUsersKey(sessionUser(c.Value), r.URL.Query().Get("chat_id"))
 	if err != nil {
 		answ.Text = "Error getting key"
 		bs, _ := json.Marshal(answ)
@@ -801,7 +950,7 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 
 	c, _ := r.Cookie(COOKIE_NAME)
 
-	res, err := dbInterface.GetUserId(users[c.Value].Id, r.URL.Query().Get("user_id"))
+	res, err := dbInterface.GetUserId(sessionUser(c.Value), r.URL.Query().Get("user_id"))
 	if err != nil {
 		answ.Text = "Error getting user"
 		bs, _ := json.Marshal(answ)
@@ -810,18 +959,66 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Статус в сети скрывается вместе со временем последнего входа
+	if dbInterface.LastSeenVisible(res.Id.Hex(), sessionUser(c.Value)) {
+		res.Online = hub.isOnline(res.Id.Hex())
+	}
+
 	b, _ := json.Marshal(res)
 	w.WriteHeader(OK)
 	fmt.Fprintf(w, string(b))
 }
 
+//Подключение по вебсокету
+//Авторизация по куке сессии или по одноразовому билету из /ws/ticket
 func webSocket(w http.ResponseWriter, r *http.Request) {
 	log.Print(" Connecting\n")
 	var answ structures.Answer
 
 	enableCors(&w, r.Header.Get("Origin"))
 
-	if !r.URL.Query().Has("user_id") {
+	token := ""
+	if verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		c, _ := r.Cookie(COOKIE_NAME)
+		token = c.Value
+	} else if r.URL.Query().Has("ticket") {
+		token = useTicket(r.URL.Query().Get("ticket"))
+	}
+
+	if token == "" {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+	user_id := sessionUser(token)
+
+	connection, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	re, _ := dbInterface.GetUsersChatsId(user_id)
+
+	var chats []string
+	for i := 0; i < len(re); i++ {
+		chats = append(chats, re[i].Chat_id.Hex())
+	}
+	c := newClient(connection, user_id, token, r.URL.Query().Get("device"), chats)
+	hub.register <- c
+	c.readPump()
+}
+
+//Выдаем одноразовый билет на подключение по вебсокету
+//Нужен клиентам, которые не могут передать куку при подключении
+func getWsTicket(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Getting websocket ticket\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
 		answ.Text = "NOT_AUTHORISED"
 		bs, _ := json.Marshal(answ)
 		w.WriteHeader(NOT_AUTHORISED)
@@ -829,36 +1026,44 @@ func webSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := r.URL.Query().Get("user_id")
+	c, _ := r.Cookie(COOKIE_NAME)
 
-	connection, _ := upgrader.Upgrade(w, r, nil)
-	re, _ := dbInterface.GetUsersChatsId(c)
+	var t structures.TicketJson
+	ticket, err := generateTicket()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+	t.Ticket = ticket
+	sessionsMutex.Lock()
+	wsTickets[t.Ticket] = structures.WsTicket{
+		Token:   c.Value,
+		Expires: time.Now().UTC().Add(WS_TICKET_TTL),
+	}
+	sessionsMutex.Unlock()
 
-	updateChats(connection, re, c)
+	bs, _ := json.Marshal(t)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
 }
 
-func updateChats(connection *websocket.Conn, array []structures.Chat_Id, user_id string) {
-	log.Println(array)
-	for i := 0; i < len(array); i++ {
-		chatUsers[array[i].Chat_id.Hex()] = append(chatUsers[array[i].Chat_id.Hex()], connection)
-		userChats[connection] = append(userChats[connection], array[i].Chat_id.Hex())
-		usersId[user_id] = connection
+//Используем билет, возвращаем токен сессии или пустую строку
+func useTicket(ticket string) string {
+	sessionsMutex.Lock()
+	t, ok := wsTickets[ticket]
+	delete(wsTickets, ticket)
+	sessionsMutex.Unlock()
+	if !ok {
+		return ""
 	}
-}
 
-func deletChatUser(connection *websocket.Conn) {
-	if array, ok := userChats[connection]; ok {
-		for i := 0; i < len(array); i++ {
-			var new_array []*websocket.Conn
-			for j := 0; j < len(chatUsers[array[i]]); j++ {
-				if chatUsers[array[i]][j] != connection {
-					new_array = append(new_array, chatUsers[array[i]][j])
-				}
-			}
-			chatUsers[array[i]] = new_array
-		}
-		delete(userChats, connection)
+	if time.Now().UTC().After(t.Expires) || !verifyToken(t.Token) {
+		return ""
 	}
+	return t.Token
 }
 
 //Получаем новые сообщения из чата
@@ -883,9 +1088,151 @@ func getNewMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Без курсора отдаем сообщения после последнего прочитанного
+	after, err := parseCursor(r, "after")
+	if err != nil {
+		answ.Text = "cursor error"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	arr, err := dbInterface.GetNewMessages(sessionUser(c.Value), r.URL.Query().Get("chat_id"), after)
+	if err != nil {
+		answ.Text = err.Error()
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+	b, _ := json.Marshal(arr)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(b))
+
+	syncReadState(sessionUser(c.Value), r.Header.Get(DEVICE_HEADER), r.URL.Query().Get("chat_id"))
+}
+
+//Поиск сообщений в незащищенных чатах пользователя
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Searching messages\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+	if !r.URL.Query().Has("q") {
+		answ.Text = "No q"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	query := r.URL.Query()
+	var filter structures.MessageSearchFilter
+	var err error
+	filter.Chat_id = query.Get("chat_id")
+	filter.User_id = query.Get("user_id")
+
+	if query.Has("from") {
+		filter.From, err = time.Parse(time.RFC3339Nano, query.Get("from"))
+	}
+	if err == nil && query.Has("to") {
+		filter.To, err = time.Parse(time.RFC3339Nano, query.Get("to"))
+	}
+	if err != nil {
+		answ.Text = "date error"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	if query.Has("has_attachments") {
+		has, err := strconv.ParseBool(query.Get("has_attachments"))
+		if err != nil {
+			answ.Text = "has_attachments error"
+			b, _ := json.Marshal(answ)
+			w.WriteHeader(NOT_DONE)
+			fmt.Fprintf(w, string(b))
+			return
+		}
+		filter.Has_attachments = &has
+	}
+
+	limit := 0
+	if query.Has("limit") {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			answ.Text = "limit error"
+			b, _ := json.Marshal(answ)
+			w.WriteHeader(NOT_DONE)
+			fmt.Fprintf(w, string(b))
+			return
+		}
+	}
+
 	c, _ := r.Cookie(COOKIE_NAME)
-	log.Println(c.Value)
-	arr, err := dbInterface.GetNewMessages(users[c.Value].Id, r.URL.Query().Get("chat_id"))
+	page, err := dbInterface.SearchMessages(sessionUser(c.Value), query.Get("q"), filter, limit, query.Get("cursor"))
+	if err != nil {
+		answ.Text = err.Error()
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+	b, _ := json.Marshal(page)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(b))
+}
+
+//Поиск открытых чатов в каталоге
+func searchChats(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Searching chats\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+	if !r.URL.Query().Has("q") {
+		answ.Text = "No q"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	limit, offset := 0, 0
+	var err error
+	if r.URL.Query().Has("limit") {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+	}
+	if err == nil && r.URL.Query().Has("offset") {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+	}
+	if err != nil {
+		answ.Text = "limit or offset error"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	arr, err := dbInterface.SearchChats(r.URL.Query().Get("q"), r.URL.Query().Get("mode"), limit, offset)
 	if err != nil {
 		answ.Text = err.Error()
 		b, _ := json.Marshal(answ)
@@ -898,36 +1245,1268 @@ func getNewMessages(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(b))
 }
 
-//Получаем порт и интерфейс для работы с бд
-func InitServer(port string, db *databaseInterface.DatabaseInterface) {
-	mrand.Seed(time.Now().Unix())
-	dbInterface = db
-	users = make(map[string]structures.TokenStore)
-	delete_users = make(map[string][]string)
-	chatUsers = make(map[string][]*websocket.Conn)
-	userChats = make(map[*websocket.Conn][]string)
-	usersId = make(map[string]*websocket.Conn)
+//Вступление в открытый чат
+func joinChat(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Joining chat\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	_, err = dbInterface.JoinChat(sessionUser(c.Value), m.Id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	subscribeUser(sessionUser(c.Value), m.Id)
+	sendChatEvent(m.Id, structures.NewEvent(structures.EVENT_MEMBER_JOINED, m.Id, 0, structures.MemberPayload{User_id: sessionUser(c.Value)}))
+}
+
+//Поиск пользователей по логину
+func searchUsers(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Searching users\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+	if !r.URL.Query().Has("q") {
+		answ.Text = "No q"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	limit, offset := 0, 0
+	var err error
+	if r.URL.Query().Has("limit") {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+	}
+	if err == nil && r.URL.Query().Has("offset") {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+	}
+	if err != nil {
+		answ.Text = "limit or offset error"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	arr, err := dbInterface.SearchUsers(sessionUser(c.Value), r.URL.Query().Get("q"), r.URL.Query().Get("mode"), limit, offset)
+	if err != nil {
+		answ.Text = err.Error()
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+	b, _ := json.Marshal(arr)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(b))
+}
+
+//Блокировка пользователя
+func blockUser(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Blocking user\n")
+	setUserBlocked(w, r, true)
+}
+
+//Разблокировка пользователя
+func unblockUser(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Unblocking user\n")
+	setUserBlocked(w, r, false)
+}
+
+func setUserBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.UserIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.SetUserBlocked(sessionUser(c.Value), m.Id, blocked)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Приглашение пользователя в чат
+func inviteUser(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Inviting user\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatUserJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.InviteUser(sessionUser(c.Value), m.Chat_id, m.User_id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	sendEvent(m.User_id, structures.NewEvent(structures.EVENT_MEMBER_INVITED, m.Chat_id, 0, structures.MemberPayload{
+		User_id:  m.User_id,
+		Actor_id: sessionUser(c.Value),
+	}))
+}
+
+//Получаем приглашения пользователя
+func getInvitations(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Getting invitations\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	arr, err := dbInterface.GetInvitations(sessionUser(c.Value))
+	if err != nil {
+		answ.Text = err.Error()
+		b, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(b))
+		return
+	}
+	b, _ := json.Marshal(arr)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(b))
+}
+
+//Принимаем приглашение в чат
+func acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Accepting invitation\n")
+	answerInvitation(w, r, true)
+}
+
+//Отклоняем приглашение в чат
+func declineInvitation(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Declining invitation\n")
+	answerInvitation(w, r, false)
+}
+
+func answerInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	if accept {
+		_, err = dbInterface.AcceptInvitation(sessionUser(c.Value), m.Id)
+	} else {
+		err = dbInterface.DeclineInvitation(sessionUser(c.Value), m.Id)
+	}
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	if accept {
+		subscribeUser(sessionUser(c.Value), m.Id)
+		sendChatEvent(m.Id, structures.NewEvent(structures.EVENT_MEMBER_JOINED, m.Id, 0, structures.MemberPayload{User_id: sessionUser(c.Value)}))
+	}
+}
+
+//Бан пользователя в чате
+func banUser(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Banning user\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.BanJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	//Большие значения переполнят time.Duration
+	if m.Duration < 0 || m.Duration > MAX_BAN_DURATION {
+		answ.Text = "invalid duration"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.BanUser(sessionUser(c.Value), m.Chat_id, m.User_id, m.Reason, time.Duration(m.Duration)*time.Second)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	event := structures.NewEvent(structures.EVENT_MEMBER_BANNED, m.Chat_id, 0, structures.MemberPayload{
+		User_id:  m.User_id,
+		Actor_id: sessionUser(c.Value),
+		Reason:   m.Reason,
+	})
+	unsubscribeUser(m.User_id, m.Chat_id)
+	sendEvent(m.User_id, event)
+	sendChatEvent(m.Chat_id, event)
+}
+
+//Снятие бана пользователя в чате
+func unbanUser(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Unbanning user\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatUserJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.UnbanUser(sessionUser(c.Value), m.Chat_id, m.User_id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Назначение администратора чата
+func promoteAdmin(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Promoting admin\n")
+	changeChatAdmins(w, r, dbInterface.PromoteAdmin)
+}
+
+//Снятие администратора чата
+func demoteAdmin(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Demoting admin\n")
+	changeChatAdmins(w, r, dbInterface.DemoteAdmin)
+}
+
+//Передача владения чатом
+func transferOwnership(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Transferring chat ownership\n")
+	changeChatAdmins(w, r, dbInterface.TransferOwnership)
+}
+
+func changeChatAdmins(w http.ResponseWriter, r *http.Request, action func(string, string, string) error) {
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatUserJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = action(sessionUser(c.Value), m.Chat_id, m.User_id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Создание или изменение роли чата
+func setChatRole(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Setting chat role\n")
+	changeChatRole(w, r, func(user_id string, m structures.RoleJSON) error {
+		permissions, err := databaseInterface.ParsePermissions(m.Permissions)
+		if err != nil {
+			return err
+		}
+		return dbInterface.SetChatRole(user_id, m.Chat_id, m.Name, permissions)
+	})
+}
+
+//Удаление роли чата
+func deleteChatRole(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Deleting chat role\n")
+	changeChatRole(w, r, func(user_id string, m structures.RoleJSON) error {
+		return dbInterface.DeleteChatRole(user_id, m.Chat_id, m.Name)
+	})
+}
+
+func changeChatRole(w http.ResponseWriter, r *http.Request, action func(string, structures.RoleJSON) error) {
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.RoleJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = action(sessionUser(c.Value), m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Назначение роли участнику чата
+func setMemberRole(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Setting member role\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.MemberRoleJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.SetMemberRole(sessionUser(c.Value), m.Chat_id, m.User_id, m.Role)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Изменение профиля и настроек чата
+func updateChat(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Updating chat\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatUpdateJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	fields, err := dbInterface.UpdateChat(
+		sessionUser(c.Value),
+		m.Chat_id,
+		m.Name,
+		m.Description,
+		m.Logo,
+		m.Logo_url,
+		m.Secured,
+		m.Search_visible,
+		m.Resend,
+		m.Users_write_permission,
+	)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	sendChatEvent(m.Chat_id, structures.NewEvent(structures.EVENT_CHAT_UPDATED, m.Chat_id, 0, structures.ChatUpdatedPayload{Fields: fields}))
+}
+
+//Отдаем JSON схему событий вебсокета
+func getEventsSchema(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r.Header.Get("Origin"))
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(OK)
+	w.Write(structures.EVENTS_SCHEMA)
+}
+
+//Отметка о прочтении чата, номер прочтения рассылается остальным устройствам пользователя
+func readChat(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Reading chat\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ReadJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	user_id := sessionUser(c.Value)
+
+	seq, err := dbInterface.MarkChatRead(user_id, m.Chat_id, m.Seq)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	device_id := r.Header.Get(DEVICE_HEADER)
+	syncEvent(user_id, device_id, structures.NewEvent(structures.EVENT_CHAT_READ, m.Chat_id, 0, structures.ReadPayload{
+		Last_read_seq: seq,
+		Device_id:     device_id,
+	}))
+}
+
+//Сохранение черновика, черновик рассылается остальным устройствам пользователя
+func saveDraft(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Saving draft\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.DraftJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	user_id := sessionUser(c.Value)
+
+	err = dbInterface.SaveDraft(user_id, m.Chat_id, m.Text)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	device_id := r.Header.Get(DEVICE_HEADER)
+	syncEvent(user_id, device_id, structures.NewEvent(structures.EVENT_DRAFT, m.Chat_id, 0, structures.DraftPayload{
+		Text:      m.Text,
+		Device_id: device_id,
+	}))
+}
+
+//Изменение видимости времени последнего входа: everyone, contacts или nobody
+func setLastSeenPrivacy(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Setting last seen visibility\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.LastSeenVisibilityJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.SetLastSeenVisibility(sessionUser(c.Value), m.Visibility)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Выход из чата
+func leaveChat(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Leaving chat\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	user_id := sessionUser(c.Value)
+
+	err = dbInterface.LeaveChat(user_id, m.Id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	unsubscribeUser(user_id, m.Id)
+	sendChatEvent(m.Id, structures.NewEvent(structures.EVENT_MEMBER_LEFT, m.Id, 0, structures.MemberPayload{User_id: user_id}))
+}
+
+//Удаление участника из чата
+func removeChatMember(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Removing chat member\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatUserJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	err = dbInterface.RemoveMember(sessionUser(c.Value), m.Chat_id, m.User_id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	event := structures.NewEvent(structures.EVENT_MEMBER_REMOVED, m.Chat_id, 0, structures.MemberPayload{
+		User_id:  m.User_id,
+		Actor_id: sessionUser(c.Value),
+	})
+	unsubscribeUser(m.User_id, m.Chat_id)
+	sendEvent(m.User_id, event)
+	sendChatEvent(m.Chat_id, event)
+}
+
+//Удаление персонального чата
+func deleteConversation(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Deleting conversation\n")
+	removeChat(w, r, dbInterface.DeleteConversation)
+}
+
+//Удаление чата владельцем
+func deleteChat(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Deleting chat\n")
+	removeChat(w, r, dbInterface.DeleteChat)
+}
+
+func removeChat(w http.ResponseWriter, r *http.Request, action func(string, string) ([]string, error)) {
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.ChatIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	members, err := action(sessionUser(c.Value), m.Id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	for i := 0; i < len(members); i++ {
+		unsubscribeUser(members[i], m.Id)
+		sendEvent(members[i], structures.NewEvent(structures.EVENT_CHAT_DELETED, m.Id, 0, nil))
+	}
+	hub.dropChat(m.Id)
+	err = eventStore.Drop(m.Id)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Удаление сообщения
+func deleteMessage(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Deleting message\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	var m structures.MessageIdJSON
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	//Unmarshal
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_DONE)
+		http.Error(w, string(bs), NOT_DONE)
+		return
+	}
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+
+	chat_id, err := dbInterface.DeleteMessage(sessionUser(c.Value), m.Id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+
+	sendChatEvent(chat_id, structures.NewEvent(structures.EVENT_MESSAGE_DELETED, chat_id, 0, structures.MessagePayload{Message_id: m.Id}))
+}
+
+//Удаление аккаунта
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	log.Print(" Deleting account\n")
+	var answ structures.Answer
+
+	enableCors(&w, r.Header.Get("Origin"))
+
+	if !verifyTokenCookie(r.Cookie(COOKIE_NAME)) {
+		answ.Text = "NOT_AUTHORISED"
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(NOT_AUTHORISED)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	user_id := sessionUser(c.Value)
+
+	err := dbInterface.DeleteAccount(user_id)
+	if err != nil {
+		answ.Text = err.Error()
+		bs, _ := json.Marshal(answ)
+		w.WriteHeader(OK)
+		fmt.Fprintf(w, string(bs))
+		return
+	}
+
+	//Закрываем все сессии и подключения пользователя
+	var tokens []string
+	sessionsMutex.Lock()
+	for token, session := range users {
+		if session.Id == user_id {
+			tokens = append(tokens, token)
+		}
+	}
+	sessionsMutex.Unlock()
+	hub.closeUser(user_id, "account deleted")
+	for i := 0; i < len(tokens); i++ {
+		deleteUser(tokens[i])
+	}
+	err = eventStore.Drop(userStream(user_id))
+	if err != nil {
+		log.Println(err)
+	}
+
+	answ.Text = "success"
+	bs, _ := json.Marshal(answ)
+	w.WriteHeader(OK)
+	fmt.Fprintf(w, string(bs))
+}
+
+//Получаем порт и интерфейс для работы с бд
+//origins - список Origin, с которых разрешен вебсокет
+func InitServer(port string, origins []string, ws WsSettings, events EventStore, db *databaseInterface.DatabaseInterface) {
+	mrand.Seed(time.Now().Unix())
+	dbInterface = db
+	users = make(map[string]structures.TokenStore)
+	delete_users = make(map[int64][]string)
+	wsTickets = make(map[string]structures.WsTicket)
+	allowedOrigins = make(map[string]bool)
+	for i := 0; i < len(origins); i++ {
+		allowedOrigins[origins[i]] = true
+	}
+
+	configureWebSocket(ws)
+	eventStore = events
+	hub = newHub()
+	go hub.run()
+	go runPresence()
 
-	go timeoutTokens() //Запускаем функцию на проверку актуальности токенов в отдельном потоке
+	go timeoutTokens()                   //Запускаем функцию на проверку актуальности токенов в отдельном потоке
+	go dbInterface.ResumeChatDeletions() //Доудаляем чаты, удаление которых было прервано
 
 	//GET Ручки
-	http.HandleFunc("/usersChats", getUsersChats)   //Получить чаты пользователя
-	http.HandleFunc("/chatUsers", getUsersOfChat)   //Получить пользователей чата
-	http.HandleFunc("/chat", getChatLite)           //Получить информацию чата
-	http.HandleFunc("/messages", getMessages)       //Получить сообщения чата
-	http.HandleFunc("/newMessages", getNewMessages) //Получить новые сообщения чата
-	http.HandleFunc("/chatKey", getChatKey)         //Получить ключ чата
-	http.HandleFunc("/user", getUser)               //Получить пользователя
-	http.HandleFunc("/ws", webSocket)               //Подключиться по вебсокету
+	http.HandleFunc("/usersChats", getUsersChats)       //Получить чаты пользователя
+	http.HandleFunc("/chatUsers", getUsersOfChat)       //Получить пользователей чата
+	http.HandleFunc("/chat", getChatLite)               //Получить информацию чата
+	http.HandleFunc("/messages", getMessages)           //Получить сообщения чата
+	http.HandleFunc("/newMessages", getNewMessages)     //Получить новые сообщения чата после курсора
+	http.HandleFunc("/chatKey", getChatKey)             //Получить ключ чата
+	http.HandleFunc("/user", getUser)                   //Получить пользователя
+	http.HandleFunc("/ws", webSocket)                   //Подключиться по вебсокету
+	http.HandleFunc("/ws/ticket", getWsTicket)          //Получить билет для подключения по вебсокету
+	http.HandleFunc("/search/messages", searchMessages) //Поиск сообщений
+	http.HandleFunc("/search/chats", searchChats)       //Поиск открытых чатов
+	http.HandleFunc("/search/users", searchUsers)       //Поиск пользователей
+	http.HandleFunc("/invitations", getInvitations)     //Получить приглашения пользователя
+	http.HandleFunc("/schema/events", getEventsSchema)  //Схема событий вебсокета
+	//GET /debug/vars регистрирует expvar: метрики подключений ws_*
 	//TODO: гет-ручка обновления токена
 
 	//POST Ручки
-	http.HandleFunc("/authorise", authoriseUser)    //Авторизовать
-	http.HandleFunc("/exit", exit)                  //Выйти
-	http.HandleFunc("/registration", registration)  //Выйти
-	http.HandleFunc("/verifyToken", verifyTokenReq) //Перепроверить токен
-	http.HandleFunc("/sendMessage", sendMessage)    //Отправить сообщение
-	http.HandleFunc("/createChat", createChat)      //Создать чат
+	http.HandleFunc("/authorise", authoriseUser)               //Авторизовать
+	http.HandleFunc("/exit", exit)                             //Выйти
+	http.HandleFunc("/registration", registration)             //Выйти
+	http.HandleFunc("/verifyToken", verifyTokenReq)            //Перепроверить токен
+	http.HandleFunc("/sendMessage", sendMessage)               //Отправить сообщение
+	http.HandleFunc("/readChat", readChat)                     //Отметить чат прочитанным
+	http.HandleFunc("/draft", saveDraft)                       //Сохранить черновик
+	http.HandleFunc("/privacy/lastSeen", setLastSeenPrivacy)   //Кому видно время последнего входа
+	http.HandleFunc("/createChat", createChat)                 //Создать чат
+	http.HandleFunc("/joinChat", joinChat)                     //Вступить в открытый чат
+	http.HandleFunc("/blockUser", blockUser)                   //Заблокировать пользователя
+	http.HandleFunc("/unblockUser", unblockUser)               //Разблокировать пользователя
+	http.HandleFunc("/invite", inviteUser)                     //Пригласить пользователя в чат
+	http.HandleFunc("/acceptInvitation", acceptInvitation)     //Принять приглашение
+	http.HandleFunc("/declineInvitation", declineInvitation)   //Отклонить приглашение
+	http.HandleFunc("/banUser", banUser)                       //Забанить пользователя в чате
+	http.HandleFunc("/unbanUser", unbanUser)                   //Снять бан пользователя
+	http.HandleFunc("/promoteAdmin", promoteAdmin)             //Назначить администратора
+	http.HandleFunc("/demoteAdmin", demoteAdmin)               //Снять администратора
+	http.HandleFunc("/transferOwnership", transferOwnership)   //Передать владение чатом
+	http.HandleFunc("/setChatRole", setChatRole)               //Создать или изменить роль чата
+	http.HandleFunc("/deleteChatRole", deleteChatRole)         //Удалить роль чата
+	http.HandleFunc("/setMemberRole", setMemberRole)           //Назначить роль участнику
+	http.HandleFunc("/updateChat", updateChat)                 //Изменить профиль и настройки чата
+	http.HandleFunc("/leaveChat", leaveChat)                   //Выйти из чата
+	http.HandleFunc("/removeMember", removeChatMember)         //Удалить участника из чата
+	http.HandleFunc("/deleteConversation", deleteConversation) //Удалить персональный чат
+	http.HandleFunc("/deleteChat", deleteChat)                 //Удалить чат
+	http.HandleFunc("/deleteMessage", deleteMessage)           //Удалить сообщение
+	http.HandleFunc("/deleteAccount", deleteAccount)           //Удалить аккаунт
 
 	log.Print(" Starting server\n")
 	log.Print(" Server started\n")
@@ -0,0 +1,98 @@
+package serverAndHandlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/MUR4SH/MyMessenger/structures"
+)
+
+//Индикатор набора гаснет, если клиент не обновил его за это время
+const TYPING_TIMEOUT = 6 * time.Second
+
+//Минимальный интервал между кадрами typing.start одного подключения
+const TYPING_RATE = time.Second
+
+//Кто сейчас печатает: ключ - чат и пользователь, значение - таймер погашения
+//Индикаторы живут только в памяти и не пишутся в журнал событий
+var typingMutex sync.Mutex
+var typingTimers = make(map[typingKey]*time.Timer)
+
+type typingKey struct {
+	chat_id string
+	user_id string
+}
+
+//Обрабатываем кадры typing.start и typing.stop
+//Печатать может только тот, кто может писать в чат: учитываются баны и Users_write_permission
+func handleTyping(c *client, frame structures.ClientFrame) {
+	if frame.Type == structures.FRAME_TYPING_STOP {
+		stopTyping(typingKey{chat_id: frame.Chat_id, user_id: c.user_id})
+		return
+	}
+
+	//Лишние обновления отбрасываем молча, индикатор и так горит
+	now := time.Now()
+	if now.Sub(c.last_typing) < TYPING_RATE {
+		return
+	}
+	c.last_typing = now
+
+	if !dbInterface.UserHasPermission(c.user_id, frame.Chat_id, structures.PERMISSION_SEND_MESSAGES) {
+		sendFrameError(c, structures.ErrorPayload{Code: structures.FRAME_FORBIDDEN, Frame: frame.Type})
+		return
+	}
+	startTyping(typingKey{chat_id: frame.Chat_id, user_id: c.user_id})
+}
+
+//Зажигаем индикатор или продлеваем уже горящий
+//При продлении таймер заменяется новым: сработавший, но ждущий блокировку обработчик
+//старого таймера увидит замену и не погасит индикатор
+func startTyping(key typingKey) {
+	typingMutex.Lock()
+	defer typingMutex.Unlock()
+
+	old, refresh := typingTimers[key]
+	if refresh {
+		old.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(TYPING_TIMEOUT, func() {
+		typingMutex.Lock()
+		defer typingMutex.Unlock()
+		//Таймер мог быть заменен продлением или новым началом набора
+		if typingTimers[key] != timer {
+			return
+		}
+		delete(typingTimers, key)
+		sendTyping(key, false)
+	})
+	typingTimers[key] = timer
+	if !refresh {
+		sendTyping(key, true)
+	}
+}
+
+func stopTyping(key typingKey) {
+	typingMutex.Lock()
+	defer typingMutex.Unlock()
+
+	timer, ok := typingTimers[key]
+	if !ok {
+		return
+	}
+	timer.Stop()
+	delete(typingTimers, key)
+	sendTyping(key, false)
+}
+
+//Рассылаем индикатор остальным участникам чата, минуя журнал событий
+func sendTyping(key typingKey, typing bool) {
+	b, _ := json.Marshal(structures.NewEvent(structures.EVENT_TYPING, key.chat_id, 0, structures.TypingPayload{
+		User_id: key.user_id,
+		Typing:  typing,
+	}))
+	hub.sendToChatExcept(key.chat_id, key.user_id, b)
+}
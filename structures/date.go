@@ -0,0 +1,84 @@
+package structures
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+//Формат даты в JSON - RFC 3339 с миллисекундами
+const JSON_DATE_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+//Формат, в котором даты хранились строками до перехода на BSON даты
+const LEGACY_DATE_FORMAT = "2006-01-02 15:04:05"
+
+//Дата, отдаваемая пользователю
+//В бд хранится как BSON дата, в JSON отдается в формате JSON_DATE_FORMAT
+type Date time.Time
+
+func (t Date) Time() time.Time {
+	return time.Time(t)
+}
+
+func (t Date) MarshalJSON() ([]byte, error) {
+	if time.Time(t).IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(time.Time(t).UTC().Format(JSON_DATE_FORMAT))
+}
+
+func (t *Date) UnmarshalJSON(b []byte) error {
+	var s *string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		*t = Date(time.Time{})
+		return nil
+	}
+
+	tm, err := time.Parse(time.RFC3339Nano, *s)
+	if err != nil {
+		return err
+	}
+	*t = Date(tm.UTC())
+	return nil
+}
+
+func (t Date) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if time.Time(t).IsZero() {
+		return bsontype.Null, nil, nil
+	}
+	return bsontype.DateTime, bsoncore.AppendDateTime(nil, time.Time(t).UnixMilli()), nil
+}
+
+//Читаем BSON дату, строки старого формата тоже поддерживаются
+func (t *Date) UnmarshalBSONValue(bt bsontype.Type, data []byte) error {
+	switch bt {
+	case bsontype.DateTime:
+		ms, _, ok := bsoncore.ReadDateTime(data)
+		if !ok {
+			return errors.New("invalid date")
+		}
+		*t = Date(time.UnixMilli(ms).UTC())
+	case bsontype.String:
+		s, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return errors.New("invalid date")
+		}
+		tm, err := time.Parse(LEGACY_DATE_FORMAT, s)
+		if err != nil && s != "" {
+			return err
+		}
+		*t = Date(tm)
+	case bsontype.Null, bsontype.Undefined:
+		*t = Date(time.Time{})
+	default:
+		return errors.New("invalid date type " + bt.String())
+	}
+	return nil
+}
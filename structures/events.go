@@ -0,0 +1,167 @@
+package structures
+
+import (
+	_ "embed"
+	"encoding/json"
+)
+
+//Версия протокола событий вебсокета
+const EVENT_VERSION = 1
+
+//JSON схема событий, отдается клиентам по /schema/events
+//
+//go:embed events.schema.json
+var EVENTS_SCHEMA []byte
+
+//Типы событий
+const EVENT_MESSAGE_CREATED = "message.created"
+const EVENT_MESSAGE_EDITED = "message.edited"
+const EVENT_MESSAGE_DELETED = "message.deleted"
+const EVENT_REACTION = "message.reaction"
+const EVENT_TYPING = "typing"
+const EVENT_PRESENCE = "presence"
+const EVENT_MEMBER_JOINED = "member.joined"
+const EVENT_MEMBER_LEFT = "member.left"
+const EVENT_MEMBER_REMOVED = "member.removed"
+const EVENT_MEMBER_BANNED = "member.banned"
+const EVENT_MEMBER_INVITED = "member.invited"
+const EVENT_CHAT_UPDATED = "chat.updated"
+const EVENT_CHAT_DELETED = "chat.deleted"
+const EVENT_CHAT_READ = "chat.read"
+const EVENT_DRAFT = "chat.draft"
+const EVENT_ERROR = "error"
+const EVENT_ACK = "ack"
+const EVENT_RESYNC = "resync"
+
+//Типы кадров клиента
+const FRAME_SUBSCRIBE = "subscribe"
+const FRAME_UNSUBSCRIBE = "unsubscribe"
+const FRAME_MESSAGE_SEND = "message.send"
+const FRAME_RESUME = "resume"
+const FRAME_TYPING_START = "typing.start"
+const FRAME_TYPING_STOP = "typing.stop"
+
+//Коды ошибок обработки кадров клиента
+const FRAME_INVALID = "invalid_frame"
+const FRAME_UNKNOWN_TYPE = "unknown_type"
+const FRAME_FORBIDDEN = "forbidden"
+const FRAME_MESSAGE_TOO_LONG = "message_too_long"
+const FRAME_SEND_FAILED = "send_failed"
+
+//Конверт события, отправляемого по вебсокету
+//Seq - номер сообщения для событий сообщений
+//Event_seq - номер события в журнале чата (или личных событий пользователя без Chat_id)
+type Event struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	Chat_id   string      `json:"chat_id,omitempty"`
+	Seq       int64       `json:"seq,omitempty"`
+	Event_seq int64       `json:"event_seq,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+//Создаем событие текущей версии
+func NewEvent(event_type string, chat_id string, seq int64, payload interface{}) Event {
+	return Event{
+		Version: EVENT_VERSION,
+		Type:    event_type,
+		Chat_id: chat_id,
+		Seq:     seq,
+		Payload: payload,
+	}
+}
+
+//Событие сообщения, Message отдается только тем, кому оно доступно
+//Device_id - устройство отправителя, по нему оно узнает свое сообщение
+type MessagePayload struct {
+	Message_id string         `json:"message_id"`
+	Message    *MessageToUser `json:"message,omitempty"`
+	Device_id  string         `json:"device_id,omitempty"`
+}
+
+type ReactionPayload struct {
+	Message_id string `json:"message_id"`
+	User_id    string `json:"user_id"`
+	Reaction   string `json:"reaction"`
+}
+
+type TypingPayload struct {
+	User_id string `json:"user_id"`
+	Typing  bool   `json:"typing"`
+}
+
+type PresencePayload struct {
+	User_id   string `json:"user_id"`
+	Online    bool   `json:"online"`
+	Last_seen Date   `json:"last_seen"`
+}
+
+//Событие участника чата, Actor_id - кто выполнил действие
+type MemberPayload struct {
+	User_id  string `json:"user_id"`
+	Actor_id string `json:"actor_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type ChatUpdatedPayload struct {
+	Fields []string `json:"fields"`
+}
+
+//События синхронизации устройств пользователя, Device_id - устройство, где произошло изменение
+type ReadPayload struct {
+	Last_read_seq int64  `json:"last_read_seq"`
+	Device_id     string `json:"device_id,omitempty"`
+}
+
+type DraftPayload struct {
+	Text      string `json:"text"`
+	Device_id string `json:"device_id,omitempty"`
+}
+
+//Ошибка обработки кадра клиента, Frame - тип кадра, вызвавшего ошибку
+//Client_id - id сообщения клиента для ошибок message.send
+type ErrorPayload struct {
+	Code      string `json:"code"`
+	Frame     string `json:"frame,omitempty"`
+	Client_id string `json:"client_id,omitempty"`
+}
+
+//Подтверждение отправки сообщения
+//Duplicate - сообщение с этим Client_id уже было отправлено раньше
+type AckPayload struct {
+	Client_id  string `json:"client_id"`
+	Message_id string `json:"message_id"`
+	Seq        int64  `json:"seq"`
+	Duplicate  bool   `json:"duplicate,omitempty"`
+}
+
+//Кадр, присылаемый клиентом по вебсокету
+//subscribe/unsubscribe с Chat_id включают и выключают события чата для этого подключения
+//message.send отправляет сообщение в Chat_id, Payload - MessageSendPayload
+//typing.start/typing.stop с Chat_id - индикатор набора, start нужно повторять, пока пользователь печатает
+type ClientFrame struct {
+	Type    string          `json:"type"`
+	Chat_id string          `json:"chat_id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+//Последние полученные номера событий: Chats - по чатам, User - личных событий
+//Отсутствующий User - личные события не повторяются
+type ResumePayload struct {
+	Chats map[string]int64 `json:"chats"`
+	User  *int64           `json:"user,omitempty"`
+}
+
+//Событие в журнале, Data - JSON события
+type StoredEvent struct {
+	Stream string
+	Seq    int64
+	Data   []byte
+}
+
+//Client_id обязателен, повтор с тем же id не создает новое сообщение
+type MessageSendPayload struct {
+	Client_id  string `json:"client_id"`
+	Text       string `json:"text"`
+	Replied_id string `json:"replied_id,omitempty"`
+}
@@ -1,6 +1,8 @@
 package structures
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -33,25 +35,126 @@ type Chat struct {
 	Id            primitive.ObjectID `bson:"_id"`
 	Chat_name     string
 	Chat_logo     primitive.ObjectID
+	Description   string
 	Users_array   []primitive.ObjectID
 	Files_array   []primitive.ObjectID
 	Options       primitive.ObjectID
+	Owner_id      primitive.ObjectID
 	Admins_array  []primitive.ObjectID
-	Invited_array []primitive.ObjectID
-	Banned_array  []primitive.ObjectID
+	Invited_array []Invitation
+	Banned_array  []Ban
+	Roles         []Role
+	Members_roles []Member_role
 	Key           []byte
+	Messages_seq  int64
+	Pair_key      string `bson:",omitempty"` //Ключ пары собеседников, только у персональных чатов
+	Deleting      bool   `bson:",omitempty"` //Чат удаляется фоновой задачей
 }
 
 type Chat_noid struct {
 	Chat_name     string
 	Chat_logo     primitive.ObjectID
+	Description   string
 	Users_array   []primitive.ObjectID
 	Files_array   []primitive.ObjectID
 	Options       primitive.ObjectID
+	Owner_id      primitive.ObjectID
 	Admins_array  []primitive.ObjectID
-	Invited_array []primitive.ObjectID
-	Banned_array  []primitive.ObjectID
+	Invited_array []Invitation
+	Banned_array  []Ban
+	Roles         []Role
+	Members_roles []Member_role
 	Key           []byte
+	Messages_seq  int64
+	Pair_key      string `bson:",omitempty"`
+}
+
+//Приглашение пользователя в чат
+type Invitation struct {
+	User_id    primitive.ObjectID
+	Inviter_id primitive.ObjectID
+	Gtm_date   Date
+	ExpiredAt  Date
+}
+
+//Приглашение, отдаваемое приглашенному пользователю
+type Invitation_lite struct {
+	Chat_id    primitive.ObjectID `bson:"_id"`
+	Chat_name  string
+	Chat_logo  []Files_Url
+	Inviter_id primitive.ObjectID
+	Gtm_date   Date
+	ExpiredAt  Date
+}
+
+//Бан пользователя в чате, без ExpiredAt бан бессрочный
+type Ban struct {
+	User_id   primitive.ObjectID
+	Banned_by primitive.ObjectID
+	Reason    string
+	Gtm_date  Date
+	ExpiredAt *Date `bson:",omitempty"`
+}
+
+//Права участника чата, битовая маска
+type Permission uint
+
+const (
+	PERMISSION_SEND_MESSAGES Permission = 1 << iota
+	PERMISSION_SEND_MEDIA
+	PERMISSION_PIN
+	PERMISSION_INVITE
+	PERMISSION_CHANGE_INFO
+	PERMISSION_DELETE_MESSAGES
+	PERMISSION_BAN
+	PERMISSION_COMMENT
+)
+
+//Все права
+const PERMISSION_ALL = PERMISSION_SEND_MESSAGES |
+	PERMISSION_SEND_MEDIA |
+	PERMISSION_PIN |
+	PERMISSION_INVITE |
+	PERMISSION_CHANGE_INFO |
+	PERMISSION_DELETE_MESSAGES |
+	PERMISSION_BAN |
+	PERMISSION_COMMENT
+
+//Названия прав в API
+var PERMISSION_NAMES = map[string]Permission{
+	"send_messages":   PERMISSION_SEND_MESSAGES,
+	"send_media":      PERMISSION_SEND_MEDIA,
+	"pin":             PERMISSION_PIN,
+	"invite":          PERMISSION_INVITE,
+	"change_info":     PERMISSION_CHANGE_INFO,
+	"delete_messages": PERMISSION_DELETE_MESSAGES,
+	"ban":             PERMISSION_BAN,
+	"comment":         PERMISSION_COMMENT,
+}
+
+//Роль чата с набором прав
+type Role struct {
+	Name        string
+	Permissions Permission
+}
+
+//Роль, назначенная участнику чата
+type Member_role struct {
+	User_id primitive.ObjectID
+	Role    string
+}
+
+//Счетчик последовательности сообщений чата
+//Pending_seq - выданные номера, сообщения с которыми еще не записаны
+type Chat_Seq struct {
+	Messages_seq int64
+	Pending_seq  []Pending_seq
+}
+
+//Выданный, но еще не записанный номер сообщения
+type Pending_seq struct {
+	Seq  int64
+	Date Date
 }
 
 type Count struct {
@@ -70,7 +173,11 @@ type Chat_lite struct {
 	Id                   primitive.ObjectID `bson:"_id"`
 	Chat_name            string
 	Chat_logo            []Files_Url
+	Description          string
+	Owner_id             primitive.ObjectID
+	Admins_array         []primitive.ObjectID
 	Users_count          int64
+	Subscribers_count    int64 //Только для каналов
 	Last_messages_number int
 	Options              []Chat_settings
 	Messages_count       Chat_MessagesCount
@@ -79,6 +186,15 @@ type Chat_lite struct {
 	User_options         []Chats_array_agregate
 }
 
+//Чат в публичном каталоге
+type Chat_public struct {
+	Id            primitive.ObjectID `bson:"_id"`
+	Chat_name     string
+	Chat_logo     []Files_Url
+	Description   string
+	Members_count int64
+}
+
 type Chat_settings struct {
 	Id                     primitive.ObjectID `bson:"_id"`
 	Chat_id                primitive.ObjectID
@@ -87,6 +203,7 @@ type Chat_settings struct {
 	Resend                 bool
 	Users_write_permission bool
 	Personal               bool
+	Channel                bool //Канал: пишут только администраторы, подписчики читают и комментируют
 }
 
 type Chat_settings_noid struct {
@@ -96,14 +213,15 @@ type Chat_settings_noid struct {
 	Resend                 bool
 	Users_write_permission bool
 	Personal               bool
+	Channel                bool
 }
 
 type Files struct {
 	Id         primitive.ObjectID `bson:"_id"`
 	Name       string
 	Type       string
-	Gtm_date   string
-	ExpiredAt  string
+	Gtm_date   Date
+	ExpiredAt  Date
 	Message_id *string
 	Url        string
 }
@@ -111,8 +229,8 @@ type Files struct {
 type Files_noid struct {
 	Name       string
 	Type       string
-	Gtm_date   string
-	ExpiredAt  string
+	Gtm_date   Date
+	ExpiredAt  Date
 	Message_id *string
 	Url        string
 }
@@ -129,6 +247,7 @@ type User struct {
 	Phone             *string
 	Chats_array       []*string
 	Photos_array      []*string
+	Blocked_array     []primitive.ObjectID
 	Status            string
 	About             string
 	Personal_settings string
@@ -139,6 +258,7 @@ type Chat_User_aggregate_lite struct {
 	Users_array []User_lite
 }
 
+//Last_seen и Online видны по настройке Last_seen_visibility
 type User_lite struct {
 	Id                primitive.ObjectID `bson:"_id"`
 	Login             string
@@ -148,6 +268,8 @@ type User_lite struct {
 	Status            string
 	About             string
 	Personal_settings Personal_settings
+	Last_seen         Date
+	Online            bool `bson:"-"`
 }
 
 type Files_Url struct {
@@ -163,6 +285,8 @@ type Chats_array struct {
 	Personal             bool
 	Secured              bool
 	Last_messages_number int
+	Last_read_seq        int64
+	Draft                string //Черновик, общий для всех устройств пользователя
 	User_chat            Chat_lite
 }
 
@@ -174,6 +298,7 @@ type Chats_array_noid struct {
 	Secured              bool
 	Key                  []byte
 	Last_messages_number int
+	Last_read_seq        int64
 }
 
 type Chats_array_agregate struct {
@@ -205,15 +330,21 @@ type AnswerBase64 struct {
 }
 
 type Personal_settings struct {
-	Id            primitive.ObjectID `bson:"_id"`
-	User_id       string
-	Phone_visible bool
-	Email_visible bool
+	Id                   primitive.ObjectID `bson:"_id"`
+	User_id              string
+	Phone_visible        bool
+	Email_visible        bool
+	Last_seen_visibility string //Кому видно время последнего входа, пусто - всем
 }
 
+//Видимость времени последнего входа и статуса в сети
+const LAST_SEEN_EVERYONE = "everyone"
+const LAST_SEEN_CONTACTS = "contacts" //Только пользователям, с которыми есть персональный чат
+const LAST_SEEN_NOBODY = "nobody"
+
 type Message struct {
 	Id             primitive.ObjectID `bson:"_id"`
-	Gtm_date       string
+	Gtm_date       time.Time
 	User_id        primitive.ObjectID
 	Text           []byte
 	Files_array    []primitive.ObjectID
@@ -221,12 +352,20 @@ type Message struct {
 	Replied_id     primitive.ObjectID
 	Comments_array []primitive.ObjectID
 	Chat_id        primitive.ObjectID
-	ExpiredAt      string
+	ExpiredAt      *time.Time `bson:",omitempty"`
+	Seq            int64
+	System         string `bson:",omitempty"`
+	Client_id      string `bson:",omitempty"`
 }
 
+//Системные сообщения чата, User_id - пользователь, о котором сообщение
+const SYSTEM_USER_LEFT = "user_left"
+const SYSTEM_USER_REMOVED = "user_removed"
+const SYSTEM_CHAT_UPDATED = "chat_updated" //Text - список измененных полей через запятую
+
 type MessageToUser struct {
 	Id             primitive.ObjectID `bson:"_id"`
-	Gtm_date       string
+	Gtm_date       Date
 	User_id        string
 	Text           []byte
 	Files_array    []string
@@ -234,11 +373,23 @@ type MessageToUser struct {
 	Replied_id     string
 	Comments_array []string
 	Chat_id        string
+	Seq            int64
+	System         string
+	Client_id      string
 	User           []User_lite
 }
 
+//Страница сообщений с курсорами
+//Next_cursor - для запроса более старых сообщений (before)
+//Prev_cursor - для запроса более новых сообщений (after)
+type MessagesPage struct {
+	Messages    []MessageToUser `json:"messages"`
+	Next_cursor string          `json:"next_cursor"`
+	Prev_cursor string          `json:"prev_cursor"`
+}
+
 type Message_noid struct {
-	Gtm_date       string
+	Gtm_date       time.Time
 	User_id        primitive.ObjectID
 	Text           []byte
 	Files_array    []primitive.ObjectID
@@ -246,6 +397,18 @@ type Message_noid struct {
 	Replied_id     primitive.ObjectID
 	Comments_array []primitive.ObjectID
 	Chat_id        primitive.ObjectID
+	Seq            int64
+	Search_text    string `bson:",omitempty"` //Текст для поиска, только в незащищенных чатах
+	System         string `bson:",omitempty"` //Тип системного сообщения
+	Client_id      string `bson:",omitempty"` //Id, сгенерированный клиентом, для повторной отправки
+}
+
+//Результат отправки сообщения
+//Duplicate - сообщение с таким Client_id уже было отправлено, возвращено оно
+type SentMessage struct {
+	Id        string
+	Seq       int64
+	Duplicate bool
 }
 
 type ID struct {
@@ -283,7 +446,17 @@ type UserAuthorise struct {
 
 type TokenStore struct {
 	Id   string
-	Date string
+	Date time.Time
+}
+
+//Одноразовый билет на подключение по вебсокету
+type WsTicket struct {
+	Token   string
+	Expires time.Time
+}
+
+type TicketJson struct {
+	Ticket string `json:"ticket"`
 }
 
 type UserJSON struct {
@@ -306,6 +479,26 @@ type CreateUserJSON struct {
 	Phone    string `json:"phone"`
 }
 
+//Фильтры поиска сообщений
+type MessageSearchFilter struct {
+	Chat_id         string
+	User_id         string
+	From            time.Time
+	To              time.Time
+	Has_attachments *bool
+}
+
+type MessageSearchResult struct {
+	Message MessageToUser `json:"message"`
+	Snippet string        `json:"snippet"`
+}
+
+//Страница результатов поиска, Next_cursor передается в cursor для следующей страницы
+type MessageSearchPage struct {
+	Results     []MessageSearchResult `json:"results"`
+	Next_cursor string                `json:"next_cursor"`
+}
+
 type MessageJSON struct {
 	Id             string   `json:"id"`
 	Gtm_date       string   `json:"gtm_date"`
@@ -317,14 +510,64 @@ type MessageJSON struct {
 	Comments_array []string `json:"comments_array"`
 	Chat_id        string   `json:"chat_id"`
 	ExpiredAt      string   `json:"expired_at"`
+	Client_id      string   `json:"client_id"`
+}
+
+type UserIdJSON struct {
+	Id string `json:"user_id"`
+}
+
+type ChatUserJSON struct {
+	Chat_id string `json:"chat_id"`
+	User_id string `json:"user_id"`
+}
+
+//Duration - длительность бана в секундах, 0 - бессрочно
+type BanJSON struct {
+	Chat_id  string `json:"chat_id"`
+	User_id  string `json:"user_id"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"`
+}
+
+type MessageIdJSON struct {
+	Id string `json:"message_id"`
+}
+
+type LastSeenVisibilityJSON struct {
+	Visibility string `json:"visibility"`
+}
+
+//Seq - номер последнего прочитанного сообщения, 0 - прочитать весь чат
+type ReadJSON struct {
+	Chat_id string `json:"chat_id"`
+	Seq     int64  `json:"seq"`
+}
+
+type DraftJSON struct {
+	Chat_id string `json:"chat_id"`
+	Text    string `json:"text"`
+}
+
+type RoleJSON struct {
+	Chat_id     string   `json:"chat_id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type MemberRoleJSON struct {
+	Chat_id string `json:"chat_id"`
+	User_id string `json:"user_id"`
+	Role    string `json:"role"`
 }
 
 type ChatIdJSON struct {
-	Id string `json:"chat_id`
+	Id string `json:"chat_id"`
 }
 
 type ChatCreationJSON struct {
 	Name                   string   `json:"name"`
+	Description            string   `json:"description"`
 	Logo                   []byte   `json:"logo"`
 	Logo_url               *string  `json:"logo_url"`
 	Users                  []string `json:"users"`
@@ -333,4 +576,18 @@ type ChatCreationJSON struct {
 	Resend                 bool     `json:"resend"`
 	Users_write_permission bool     `json:"users_write_permission"`
 	Personal               bool     `json:"personal"`
+	Channel                bool     `json:"channel"`
+}
+
+//Изменение чата, nil поля не меняются
+type ChatUpdateJSON struct {
+	Chat_id                string  `json:"chat_id"`
+	Name                   *string `json:"name"`
+	Description            *string `json:"description"`
+	Logo                   []byte  `json:"logo"`
+	Logo_url               *string `json:"logo_url"`
+	Secured                *bool   `json:"secured"`
+	Search_visible         *bool   `json:"search_visible"`
+	Resend                 *bool   `json:"resend"`
+	Users_write_permission *bool   `json:"users_write_permission"`
 }